@@ -1,15 +1,15 @@
 package main
 
 import (
-	"crypto/sha256"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
+	"go.serve/internal/proxy"
 	"go.serve/internal/request"
 	"go.serve/internal/response"
 	"go.serve/internal/server"
@@ -56,65 +56,24 @@ func get500() []byte {
 </html>`)
 }
 
-func getVideo() []byte {
-	v, err := os.ReadFile("assets/vim.mp4")
+// serveVideo streams the file from disk, with sendfile where possible, and
+// lets players seek with Range requests.
+func serveVideo(w *response.Writer, req *request.Request) {
+	f, err := os.Open("assets/vim.mp4")
 	if err != nil {
-		return nil
-	}
-	return v
-}
-
-func proxyRequest(w *response.Writer, endpoint string) {
-	h := response.GetDefaultHeaders(0)
-
-	resp, err := http.Get("https://httpbin.org" + endpoint)
-
-	if err != nil {
-		w.WriteStatusLine(response.StatusInternalServerError)
-		body := get500()
-		h.Replace("Content-Type", "text/html")
-		h.Replace("Content-Length", fmt.Sprintf("%d", len(body)))
+		h := response.GetDefaultHeaders(0)
+		w.WriteStatusLine(response.StatusNotFound)
 		w.WriteHeaders(h)
-		w.WriteBody(body)
+		return
 	}
-	tr := response.GetDefaultTrailers()
-
-	w.WriteStatusLine(response.StatusOK)
-	h.Delete("Content-Length")
-	h.Set("Transfer-Encoding", "chunked")
-	h.Set("Trailer", "X-Content-SHA256")
-	h.Set("Trailer", "X-Content-Length")
-	h.Replace("Content-Type", "text/plain")
-	w.WriteHeaders(h)
+	defer f.Close()
 
-	fullBody := []byte{}
-	bodyLen := 0
-	for {
-		data := make([]byte, 1024)
-		n, err := resp.Body.Read(data)
-		if err != nil {
-			break
-		}
-		fullBody = append(fullBody, data[:n]...)
-		l, err := w.WriteChunkedBody(data)
-		if err != nil {
-			// handle error
-			break
-		}
-		bodyLen += l
-	}
-	l, err := w.WriteChunkedBodyDone()
-	if err != nil {
-		// handle error
+	h := response.GetDefaultHeaders(0)
+	h.Replace("Content-Type", "video/mp4")
+	rangeHeader, _ := req.Headers.Get("range")
+	if err := w.WriteFile(f, h, rangeHeader); err != nil {
+		log.Printf("Error sending video: %v", err)
 	}
-
-	bodyLen += l
-
-	tr.Replace("X-Content-SHA256", fmt.Sprintf("%x", sha256.Sum256(fullBody)))
-	tr.Replace("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-
-	w.WriteTrailers(tr)
-	return
 }
 
 func handleRequest(w *response.Writer, req *request.Request) {
@@ -124,7 +83,7 @@ func handleRequest(w *response.Writer, req *request.Request) {
 	body := get200()
 	status := response.StatusOK
 
-	switch req.RequestLine.RequestTarget {
+	switch req.Path() {
 	case "/yourproblem":
 		body = get400()
 		status = response.StatusBadRequest
@@ -132,15 +91,7 @@ func handleRequest(w *response.Writer, req *request.Request) {
 		body = get500()
 		status = response.StatusInternalServerError
 	case "/video":
-		body = getVideo()
-		h.Replace("Content-Type", "video/mp4")
-	}
-
-	// To test chunked encoding we will proxy requests to httpbin.org
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		endpoint := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-		fmt.Println("Proxying request...")
-		proxyRequest(w, endpoint)
+		serveVideo(w, req)
 		return
 	}
 
@@ -150,10 +101,66 @@ func handleRequest(w *response.Writer, req *request.Request) {
 	w.WriteBody(body)
 }
 
+// Destinations CONNECT may never reach unless -connect-deny says otherwise:
+// this host, the cloud metadata service and private networks
+const internalDestinations = "localhost,127.0.0.0/8,::1,0.0.0.0/8,10.0.0.0/8,172.16.0.0/12," +
+	"192.168.0.0/16,100.64.0.0/10,169.254.0.0/16,fc00::/7,fe80::/10"
+
+// Comma separated host[:port] rules for CONNECT destinations, e.g.
+// "*.github.com:443,10.0.0.0/8"
+func splitRules(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func main() {
-	server, err := server.Serve(port, handleRequest)
+	connectAllow := flag.String("connect-allow", "", "destinations CONNECT may reach, e.g. \"*:443\"; CONNECT is off if empty")
+	connectDeny := flag.String("connect-deny", internalDestinations, "destinations CONNECT may never reach")
+	flag.Parse()
+
+	router := server.NewRouter()
+	router.Handle(request.MethodGet, "/", handleRequest)
+
+	// To test chunked encoding we proxy requests to httpbin.org
+	httpbin, err := proxy.NewReverseProxy(proxy.ReverseOptions{
+		Upstream:    "https://httpbin.org",
+		StripPrefix: "/httpbin",
+	})
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+	for _, method := range []string{request.MethodGet, request.MethodPost, request.MethodPut, request.MethodPatch, request.MethodDelete} {
+		router.Handle(method, "/httpbin/", httpbin.Serve)
+	}
+
+	// Forwarding to arbitrary hosts is opt-in, without an allow list
+	// CONNECT isn't served at all
+	var tunnel *proxy.Tunnel
+	if *connectAllow != "" {
+		tunnel, err = proxy.NewTunnel(proxy.TunnelOptions{
+			Allow: splitRules(*connectAllow),
+			Deny:  splitRules(*connectDeny),
+		})
+		if err != nil {
+			log.Fatalf("Error configuring CONNECT: %v", err)
+		}
+	}
+
+	// CONNECT names a host rather than a path, so it bypasses the router.
+	// Without a tunnel the router answers it like any unknown target.
+	handler := func(w *response.Writer, req *request.Request) {
+		if tunnel != nil && req.RequestLine.Method == request.MethodConnect {
+			tunnel.Serve(w, req)
+			return
+		}
+		router.Serve(w, req)
+	}
+
+	server, err := server.Serve(port, handler)
 	if err != nil {
-		log.Fatal("Error starting server: %v", err)
+		log.Fatalf("Error starting server: %v", err)
 	}
 	defer server.Close()
 	log.Println("Server started on port", port)
@@ -0,0 +1,197 @@
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"go.serve/internal/headers"
+)
+
+var ERROR_MALFORMED_CHUNK = fmt.Errorf("Malformed chunked encoding")
+var ERROR_CHUNK_LINE_TOO_LONG = fmt.Errorf("Chunk size line too long")
+var ERROR_TRAILERS_TOO_LARGE = fmt.Errorf("Trailer section too large")
+
+const (
+	// Longest chunk-size line, including any chunk extensions
+	maxLineSize = 4096
+	// Largest trailer section we are willing to hold on to
+	maxTrailerSize = 8192
+)
+
+var SEPARATOR = []byte("\r\n")
+
+type readerState int
+
+const (
+	stateSize     readerState = 0
+	stateData     readerState = 1
+	stateDataEnd  readerState = 2
+	stateTrailers readerState = 3
+	stateDone     readerState = 4
+)
+
+// Reader decodes a chunked body (RFC 9112 section 7.1) from src. Any
+// trailer fields are added to Trailers once the last chunk is read.
+type Reader struct {
+	src       *bufio.Reader
+	state     readerState
+	remaining uint64
+	trailers  *headers.Headers
+	err       error
+}
+
+func NewReader(src *bufio.Reader, trailers *headers.Headers) *Reader {
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+
+	return &Reader{
+		src:      src,
+		state:    stateSize,
+		trailers: trailers,
+	}
+}
+
+// readLine returns one CRLF terminated line without the CRLF
+func (r *Reader) readLine(limit int) ([]byte, error) {
+	line, err := r.src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > limit {
+		return nil, ERROR_CHUNK_LINE_TOO_LONG
+	}
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(line, SEPARATOR) {
+		return nil, ERROR_MALFORMED_CHUNK
+	}
+
+	return line[:len(line)-len(SEPARATOR)], nil
+}
+
+func parseSize(line []byte) (uint64, error) {
+	// Chunk extensions are allowed but we have no use for them. Whitespace
+	// is only trimmed at the end of the line, not before the ";", the same
+	// as net/http, so a proxy in front can't read a size we reject.
+	line = bytes.TrimRight(line, " \t")
+	if idx := bytes.IndexByte(line, ';'); idx != -1 {
+		line = line[:idx]
+	}
+
+	if len(line) == 0 || len(line) > 16 {
+		return 0, ERROR_MALFORMED_CHUNK
+	}
+
+	var size uint64
+	for _, ch := range line {
+		var v byte
+		switch {
+		case ch >= '0' && ch <= '9':
+			v = ch - '0'
+		case ch >= 'a' && ch <= 'f':
+			v = ch - 'a' + 10
+		case ch >= 'A' && ch <= 'F':
+			v = ch - 'A' + 10
+		default:
+			return 0, ERROR_MALFORMED_CHUNK
+		}
+		size = size<<4 | uint64(v)
+	}
+
+	return size, nil
+}
+
+func (r *Reader) readTrailers() error {
+	size := 0
+	for {
+		line, err := r.readLine(maxLineSize)
+		if err != nil {
+			return err
+		}
+
+		if len(line) == 0 {
+			return nil
+		}
+
+		size += len(line)
+		if size > maxTrailerSize {
+			return ERROR_TRAILERS_TOO_LARGE
+		}
+
+		// Copy the line so the CRLF is not appended into the read buffer
+		_, _, err = r.trailers.Parse(append(line[:len(line):len(line)], SEPARATOR...))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		switch r.state {
+		case stateSize:
+			line, err := r.readLine(maxLineSize)
+			if err != nil {
+				r.err = err
+				break
+			}
+
+			r.remaining, r.err = parseSize(line)
+			if r.remaining == 0 {
+				r.state = stateTrailers
+			} else {
+				r.state = stateData
+			}
+
+		case stateData:
+			if len(p) == 0 {
+				return 0, nil
+			}
+
+			if uint64(len(p)) > r.remaining {
+				p = p[:r.remaining]
+			}
+
+			n, err := r.src.Read(p)
+			r.remaining -= uint64(n)
+			if r.remaining == 0 {
+				r.state = stateDataEnd
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				r.err = err
+			}
+			return n, err
+
+		case stateDataEnd:
+			line, err := r.readLine(len(SEPARATOR))
+			if err == ERROR_CHUNK_LINE_TOO_LONG || err == nil && len(line) != 0 {
+				err = ERROR_MALFORMED_CHUNK
+			}
+			if err != nil {
+				r.err = err
+				break
+			}
+			r.state = stateSize
+
+		case stateTrailers:
+			if err := r.readTrailers(); err != nil {
+				r.err = err
+				break
+			}
+			r.state = stateDone
+
+		case stateDone:
+			return 0, io.EOF
+		}
+	}
+
+	return 0, r.err
+}
@@ -0,0 +1,118 @@
+package chunked
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+)
+
+func decode(data string) (string, *headers.Headers, string, error) {
+	src := bufio.NewReader(strings.NewReader(data))
+	trailers := headers.NewHeaders()
+
+	body, err := io.ReadAll(NewReader(src, trailers))
+	rest, _ := io.ReadAll(src)
+	return string(body), trailers, string(rest), err
+}
+
+func TestChunkedReader(t *testing.T) {
+	// Test: Chunks, extensions and trailers
+	body, trailers, rest, err := decode("5\r\nhello\r\n7;name=value\r\n, world\r\n0\r\nExpires: never\r\n\r\nNEXT")
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", body)
+	expires, _ := trailers.Get("expires")
+	assert.Equal(t, "never", expires)
+	assert.Equal(t, "NEXT", rest)
+
+	// Test: Upper case hex
+	body, _, _, err = decode("A\r\n0123456789\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", body)
+
+	// Test: Truncated body
+	_, _, _, err = decode("5\r\nhel")
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// Test: Missing last chunk
+	_, _, _, err = decode("5\r\nhello\r\n")
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// Test: Malformed input
+	malformed := []string{
+		"x\r\nhello\r\n0\r\n\r\n",
+		"5\r\nhelloXX\r\n0\r\n\r\n",
+		"5\nhello\r\n0\r\n\r\n",
+		"\r\nhello\r\n0\r\n\r\n",
+		"-5\r\nhello\r\n0\r\n\r\n",
+		"11111111111111111\r\n",
+		"5\t;ext\r\nhello\r\n0\r\n\r\n",
+	}
+	for _, data := range malformed {
+		_, _, _, err = decode(data)
+		assert.Equal(t, ERROR_MALFORMED_CHUNK, err, "%q", data)
+	}
+
+	// Test: Malformed trailer
+	_, _, _, err = decode("0\r\nBad Name: x\r\n\r\n")
+	assert.Error(t, err)
+}
+
+func FuzzChunkedReader(f *testing.F) {
+	for _, seed := range []string{
+		"5\r\nhello\r\n7;name=value\r\n, world\r\n0\r\nExpires: never\r\n\r\nNEXT",
+		"A\r\n0123456789\r\n0\r\n\r\n",
+		"5;a=\"x;y\"\r\nhello\r\n0\r\n\r\n",
+		"5 \r\nhello\r\n0\r\n\r\n",
+		"5\t;ext\r\nhello\r\n0\r\n\r\n",
+		"0x5\r\nhello\r\n0\r\n\r\n",
+		"5\nhello\n0\n\n",
+		"5\r\nhelloXX\r\n0\r\n\r\n",
+		"10000000000000005\r\nhello\r\n0\r\n\r\n",
+		"0\r\n Transfer-Encoding: chunked\r\n\r\n",
+		"0\r\nBad Name: x\r\n\r\n",
+		"5\r\nhel",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		body, trailers, rest, err := decode(string(data))
+		if err != nil {
+			return
+		}
+
+		// net/http reads the same body, so a proxy built on it would
+		// forward exactly what we saw
+		theirs, err := io.ReadAll(httputil.NewChunkedReader(bufio.NewReader(strings.NewReader(string(data)))))
+		if err != nil {
+			t.Errorf("%q: we read %q, net/http failed with %v", data, body, err)
+		} else if string(theirs) != body {
+			t.Errorf("%q: we read %q, net/http read %q", data, body, theirs)
+		}
+
+		// Encoding what we read gives it back
+		var sb strings.Builder
+		if body != "" {
+			fmt.Fprintf(&sb, "%x\r\n%s\r\n", len(body), body)
+		}
+		sb.WriteString("0\r\n")
+		trailers.Lines(func(name, value string) error {
+			sb.WriteString(name + ": " + value + "\r\n")
+			return nil
+		})
+		sb.WriteString("\r\n" + rest)
+
+		again, _, againRest, err := decode(sb.String())
+		require.NoError(t, err, "%q", sb.String())
+		assert.Equal(t, body, again)
+		assert.Equal(t, rest, againRest)
+	})
+}
@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+const (
+	defaultDialTimeout    = 10 * time.Second
+	defaultIdleTimeout    = 90 * time.Second
+	defaultMaxIdlePerHost = 4
+	defaultMaxRedirects   = 10
+	// How much of a redirect's body is read so its connection can be reused
+	maxDiscard = 64 << 10
+)
+
+// Setting a deadline in the past wakes up blocked reads and writes
+var aLongTimeAgo = time.Unix(1, 0)
+
+var ERROR_TOO_MANY_REDIRECTS = fmt.Errorf("Too many redirects")
+
+type Options struct {
+	// Timeout limits a whole exchange, reading the response body
+	// included. Zero means no limit.
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection is kept unused, 90s
+	// by default
+	IdleTimeout    time.Duration
+	MaxIdlePerHost int
+	// MaxRedirects is how many redirects Do follows, 10 by default.
+	// Negative returns redirects to the caller.
+	MaxRedirects int
+	TLSConfig    *tls.Config
+}
+
+// Client sends HTTP/1.1 requests, keeping connections open between them.
+type Client struct {
+	opts   Options
+	dialer *net.Dialer
+	pool   *pool
+}
+
+func NewClient(opts Options) *Client {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	if opts.MaxIdlePerHost <= 0 {
+		opts.MaxIdlePerHost = defaultMaxIdlePerHost
+	}
+	if opts.MaxRedirects == 0 {
+		opts.MaxRedirects = defaultMaxRedirects
+	}
+
+	return &Client{
+		opts:   opts,
+		dialer: &net.Dialer{Timeout: opts.DialTimeout},
+		pool:   newPool(opts.MaxIdlePerHost, opts.IdleTimeout),
+	}
+}
+
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest(request.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// CloseIdle closes the connections kept for reuse.
+func (c *Client) CloseIdle() {
+	c.pool.closeAll()
+}
+
+// Do sends req and follows the redirects it gets. The caller must close
+// the response body, which hands its connection back for reuse.
+func (c *Client) Do(req *Request) (*Response, error) {
+	for redirects := 0; ; redirects++ {
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.opts.MaxRedirects < 0 {
+			return resp, nil
+		}
+		next := redirect(req, resp)
+		if next == nil {
+			return resp, nil
+		}
+
+		io.CopyN(io.Discard, resp.Body, maxDiscard)
+		resp.Body.Close()
+		if redirects >= c.opts.MaxRedirects {
+			return nil, ERROR_TOO_MANY_REDIRECTS
+		}
+		req = next
+	}
+}
+
+// redirect builds the request that follows resp, or returns nil when resp
+// should go to the caller.
+func redirect(req *Request, resp *Response) *Request {
+	switch response.StatusCode(resp.StatusCode) {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+
+	location, ok := resp.Headers.Get("location")
+	if !ok {
+		return nil
+	}
+	u, err := req.URL.Parse(location)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+
+	next := &Request{
+		Method:        req.Method,
+		URL:           u,
+		Headers:       req.Headers.Clone(),
+		Body:          req.Body,
+		ContentLength: req.ContentLength,
+		Trailers:      req.Trailers,
+		ctx:           req.ctx,
+	}
+
+	switch response.StatusCode(resp.StatusCode) {
+	case response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		// The method and body must be kept, but the body has been sent
+		if req.Body != nil && req.ContentLength != 0 {
+			return nil
+		}
+	default:
+		if req.Method != request.MethodHead {
+			next.Method = request.MethodGet
+		}
+		next.Body = nil
+		next.ContentLength = 0
+		next.Trailers = nil
+		next.Headers.Delete("content-type")
+	}
+
+	// Credentials are only meant for the host they were given to
+	if !strings.EqualFold(u.Host, req.URL.Host) {
+		next.Headers.Delete("host")
+		next.Headers.Delete("authorization")
+		next.Headers.Delete("cookie")
+	}
+
+	return next
+}
+
+// RoundTrip sends req once and reads the response head, without following
+// redirects.
+func (c *Client) RoundTrip(req *Request) (*Response, error) {
+	key, addr, err := destination(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc := c.pool.get(key); pc != nil {
+		resp, err := c.exchange(pc, req)
+		// The server may have closed the idle connection in the meantime,
+		// which is only worth another try when the request can be repeated
+		if err == nil || !req.replayable() || req.Context().Err() != nil {
+			return resp, err
+		}
+	}
+
+	pc, err := c.dial(req.Context(), req.URL, key, addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(pc, req)
+}
+
+// destination returns the pool key and dial address for u.
+func destination(u *url.URL) (string, string, error) {
+	port := u.Port()
+	switch u.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	default:
+		return "", "", ERROR_UNSUPPORTED_SCHEME
+	}
+
+	addr := net.JoinHostPort(u.Hostname(), port)
+	return u.Scheme + "://" + addr, addr, nil
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL, key, addr string) (*persistConn, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "https" {
+		config := &tls.Config{}
+		if c.opts.TLSConfig != nil {
+			config = c.opts.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, config)
+		hctx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(hctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return newPersistConn(conn, key), nil
+}
+
+// exchange writes req on pc and reads the response head. The connection
+// belongs to the response body from then on.
+func (c *Client) exchange(pc *persistConn, req *Request) (*Response, error) {
+	ctx := req.Context()
+
+	var deadline time.Time
+	if c.opts.Timeout > 0 {
+		deadline = time.Now().Add(c.opts.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	pc.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.SetDeadline(aLongTimeAgo)
+	})
+
+	// A body is written while the response is read, as the server may
+	// answer before taking all of it. written is closed once the writer
+	// is done with req.Body.
+	var writeErr error
+	written := make(chan struct{})
+
+	// Closing the connection stops the writer at its next write, but it
+	// may be reading req.Body, which is the caller's again once we return
+	closeAndWait := func() {
+		pc.conn.Close()
+		<-written
+	}
+
+	fail := func(err error) (*Response, error) {
+		stop()
+		closeAndWait()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if req.Body != nil && req.ContentLength != 0 {
+		go func() {
+			err := req.write(pc.bw)
+			writeErr = err
+			close(written)
+			// Nothing sensible can follow a broken request
+			if err != nil {
+				pc.conn.Close()
+			}
+		}()
+	} else {
+		writeErr = req.write(pc.bw)
+		close(written)
+		if writeErr != nil {
+			return fail(writeErr)
+		}
+	}
+
+	resp, err := readResponse(pc.br, req.Method)
+	if err != nil {
+		// A failed write explains a missing response better
+		select {
+		case <-written:
+			if writeErr != nil {
+				err = writeErr
+			}
+		default:
+		}
+		return fail(err)
+	}
+	resp.Request = req
+
+	reuse := resp.KeepAlive() && !req.Headers.HasToken("connection", "close")
+	b := &body{
+		src: resp.Body,
+		done: func(ok bool) {
+			stop()
+			// The request must be out before another can follow it. A body
+			// still being sent would hold up the caller until it is all
+			// read, so the connection is given up instead, which stops the
+			// writer at its next write. Close waits for that.
+			if ok && reuse {
+				select {
+				case <-written:
+					if writeErr == nil && ctx.Err() == nil {
+						c.pool.put(pc)
+						return
+					}
+				default:
+				}
+			}
+			pc.conn.Close()
+		},
+		wait: func() {
+			<-written
+		},
+	}
+	resp.Body = b
+	// Nothing to wait for, the connection can go back right away
+	if resp.empty {
+		b.finish(true)
+	}
+
+	return resp, nil
+}
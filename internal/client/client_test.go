@@ -0,0 +1,357 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+	"go.serve/internal/server"
+)
+
+func startServer(t *testing.T, handler server.Handler, opts ...server.Option) string {
+	s, err := server.Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+// startRaw answers every connection with raw and closes it.
+func startRaw(t *testing.T, raw string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				conn.Read(buf)
+				conn.Write([]byte(raw))
+			}()
+		}
+	}()
+
+	return "http://" + l.Addr().String()
+}
+
+func reply(w *response.Writer, status response.StatusCode, body string) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func readBody(t *testing.T, resp *Response) string {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		reply(w, response.StatusOK, req.RemoteAddr)
+	})
+	c := NewClient(Options{})
+	defer c.CloseIdle()
+
+	// Test: Requests share one connection once bodies are read
+	resp, err := c.Get(url + "/")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, int64(len(readBody(t, resp))), resp.ContentLength)
+
+	first := ""
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(url + "/")
+		require.NoError(t, err)
+		addr := readBody(t, resp)
+		if first == "" {
+			first = addr
+		}
+		assert.Equal(t, first, addr)
+	}
+
+	// Test: A body closed early gives up its connection
+	resp, err = c.Get(url + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = c.Get(url + "/")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, readBody(t, resp))
+}
+
+func TestStaleConnection(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		reply(w, response.StatusOK, "ok")
+	}, server.WithIdleTimeout(20*time.Millisecond))
+	c := NewClient(Options{})
+	defer c.CloseIdle()
+
+	resp, err := c.Get(url + "/")
+	require.NoError(t, err)
+	readBody(t, resp)
+
+	// Test: A GET on a connection the server has since closed is retried
+	time.Sleep(100 * time.Millisecond)
+	resp, err = c.Get(url + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+}
+
+func TestChunkedResponse(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Done")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+
+		tr := headers.NewHeaders()
+		tr.Set("X-Done", "yes")
+		w.WriteTrailers(*tr)
+	})
+	c := NewClient(Options{})
+	defer c.CloseIdle()
+
+	// Test: The body is decoded and trailers are filled in once read
+	resp, err := c.Get(url + "/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "hello world", readBody(t, resp))
+	done, _ := resp.Trailers.Get("x-done")
+	assert.Equal(t, "yes", done)
+}
+
+func TestResponseFraming(t *testing.T) {
+	c := NewClient(Options{})
+	defer c.CloseIdle()
+
+	// Test: A body without length runs until the connection closes
+	resp, err := c.Get(startRaw(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end"))
+	require.NoError(t, err)
+	assert.False(t, resp.KeepAlive())
+	assert.Equal(t, "until the end", readBody(t, resp))
+
+	// Test: Interim responses are skipped
+	resp, err = c.Get(startRaw(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hi", readBody(t, resp))
+
+	// Test: A body cut short
+	resp, err = c.Get(startRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Garbage
+	for raw, want := range map[string]error{
+		"HTTP/2 200 OK\r\n\r\n":    response.ERROR_MALFORMED_STATUS_LINE,
+		"HTTP/1.1 2000 OK\r\n\r\n": response.ERROR_MALFORMED_STATUS_LINE,
+		"HTTP/1.1 200 OK\n\n":      io.ErrUnexpectedEOF,
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n": response.ERROR_INVALID_CONTENT_LENGTH,
+	} {
+		_, err = c.Get(startRaw(t, raw))
+		assert.ErrorIs(t, err, want, raw)
+	}
+}
+
+func TestBodilessResponses(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/empty" {
+			w.WriteStatusLine(response.StatusNoContent)
+			w.WriteHeaders(*headers.NewHeaders())
+			return
+		}
+		reply(w, response.StatusOK, "twelve bytes")
+	})
+	c := NewClient(Options{})
+	defer c.CloseIdle()
+
+	// Test: HEAD keeps the length but has no body, and the connection
+	// stays usable
+	req, err := NewRequest(request.MethodHead, url+"/", nil)
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), resp.ContentLength)
+	assert.Equal(t, "", readBody(t, resp))
+
+	resp, err = c.Get(url + "/empty")
+	require.NoError(t, err)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "", readBody(t, resp))
+
+	resp, err = c.Get(url + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "twelve bytes", readBody(t, resp))
+}
+
+func TestRequestBodies(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		body, _ := io.ReadAll(req.BodyReader())
+		sum, _ := req.Trailers.Get("x-sum")
+		te, _ := req.Headers.Get("transfer-encoding")
+		reply(w, response.StatusOK, fmt.Sprintf("%s %s|%s|%s", req.RequestLine.Method, te, body, sum))
+	})
+	c := NewClient(Options{})
+	defer c.CloseIdle()
+
+	// Test: Known length
+	req, err := NewRequest(request.MethodPost, url+"/", strings.NewReader("fixed"))
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST |fixed|", readBody(t, resp))
+
+	// Test: Streamed bodies are chunked and carry trailers
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("one "))
+		pw.Write([]byte("two"))
+		pw.Close()
+	}()
+	req, err = NewRequest(request.MethodPut, url+"/", pr)
+	require.NoError(t, err)
+	req.Trailers = headers.NewHeaders()
+	req.Trailers.Set("X-Sum", "42")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT chunked|one two|42", readBody(t, resp))
+
+	// Test: A body shorter than announced
+	req, err = NewRequest(request.MethodPost, url+"/", strings.NewReader("abc"))
+	require.NoError(t, err)
+	req.ContentLength = 10
+	_, err = c.Do(req)
+	assert.ErrorIs(t, err, ERROR_BODY_TOO_SHORT)
+}
+
+func TestTimeouts(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(200 * time.Millisecond)
+		reply(w, response.StatusOK, "late")
+	})
+
+	// Test: Timeout
+	c := NewClient(Options{Timeout: 50 * time.Millisecond})
+	start := time.Now()
+	_, err := c.Get(url + "/")
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+
+	// Test: Cancelling the request's context
+	c = NewClient(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, err := NewRequest(request.MethodGet, url+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req.WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Test: Unsupported scheme
+	_, err = c.Get("ftp://example.com/")
+	assert.ErrorIs(t, err, ERROR_UNSUPPORTED_SCHEME)
+}
+
+func TestRedirects(t *testing.T) {
+	other := startServer(t, func(w *response.Writer, req *request.Request) {
+		auth, _ := req.Headers.Get("authorization")
+		reply(w, response.StatusOK, "other auth="+auth)
+	})
+
+	var url string
+	url = startServer(t, func(w *response.Writer, req *request.Request) {
+		redirect := func(status response.StatusCode, location string) {
+			h := response.GetDefaultHeaders(0)
+			h.Set("Location", location)
+			w.WriteStatusLine(status)
+			w.WriteHeaders(h)
+		}
+
+		switch req.Path() {
+		case "/found":
+			redirect(response.StatusFound, "/target")
+		case "/temporary":
+			redirect(response.StatusTemporaryRedirect, "/target")
+		case "/away":
+			redirect(response.StatusMovedPermanently, other+"/")
+		case "/loop":
+			redirect(response.StatusFound, url+"/loop")
+		default:
+			body, _ := io.ReadAll(req.BodyReader())
+			auth, _ := req.Headers.Get("authorization")
+			reply(w, response.StatusOK, fmt.Sprintf("%s %s %s auth=%s", req.RequestLine.Method, req.Path(), body, auth))
+		}
+	})
+	c := NewClient(Options{MaxRedirects: 3})
+	defer c.CloseIdle()
+
+	do := func(method, path, body string) (*Response, error) {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req, err := NewRequest(method, url+path, r)
+		require.NoError(t, err)
+		req.Headers.Set("Authorization", "secret")
+		return c.Do(req)
+	}
+
+	// Test: 302 turns a POST into a GET without body
+	resp, err := do(request.MethodPost, "/found", "data")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /target  auth=secret", readBody(t, resp))
+
+	// Test: 307 keeps the method
+	resp, err = do(request.MethodDelete, "/temporary", "")
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE /target  auth=secret", readBody(t, resp))
+
+	// Test: A 307 for a request whose body has been sent is returned
+	resp, err = do(request.MethodPost, "/temporary", "data")
+	require.NoError(t, err)
+	assert.Equal(t, 307, resp.StatusCode)
+	readBody(t, resp)
+
+	// Test: Credentials stay behind on another host
+	resp, err = do(request.MethodGet, "/away", "")
+	require.NoError(t, err)
+	assert.Equal(t, "other auth=", readBody(t, resp))
+
+	// Test: Loops end
+	_, err = do(request.MethodGet, "/loop", "")
+	assert.ErrorIs(t, err, ERROR_TOO_MANY_REDIRECTS)
+
+	// Test: Redirects can be left to the caller
+	c = NewClient(Options{MaxRedirects: -1})
+	resp, err = do(request.MethodGet, "/found", "")
+	require.NoError(t, err)
+	assert.Equal(t, 302, resp.StatusCode)
+	location, _ := resp.Headers.Get("location")
+	assert.Equal(t, "/target", location)
+	readBody(t, resp)
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+type persistConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+	// key is the scheme://host:port the connection leads to
+	key       string
+	reused    bool
+	idleSince time.Time
+}
+
+func newPersistConn(conn net.Conn, key string) *persistConn {
+	return &persistConn{
+		conn: conn,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+		key:  key,
+	}
+}
+
+// pool keeps idle keep-alive connections per destination.
+type pool struct {
+	mu      sync.Mutex
+	idle    map[string][]*persistConn
+	maxIdle int
+	timeout time.Duration
+}
+
+func newPool(maxIdle int, timeout time.Duration) *pool {
+	return &pool{
+		idle:    map[string][]*persistConn{},
+		maxIdle: maxIdle,
+		timeout: timeout,
+	}
+}
+
+// get takes the most recently used idle connection to key, closing any
+// that have been idle for too long on the way.
+func (p *pool) get(key string) *persistConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(pc.idleSince) < p.timeout {
+			p.idle[key] = conns
+			pc.reused = true
+			return pc
+		}
+		pc.conn.Close()
+	}
+
+	delete(p.idle, key)
+	return nil
+}
+
+// put keeps pc for another request, or closes it when the destination
+// already has enough idle connections.
+func (p *pool) put(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[pc.key]) >= p.maxIdle {
+		pc.conn.Close()
+		return
+	}
+
+	pc.conn.SetDeadline(time.Time{})
+	pc.idleSince = time.Now()
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+}
+
+func (p *pool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conns := range p.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+		delete(p.idle, key)
+	}
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+)
+
+var ERROR_UNSUPPORTED_SCHEME = fmt.Errorf("Unsupported URL scheme")
+var ERROR_BODY_TOO_SHORT = fmt.Errorf("Request body shorter than its Content-Length")
+
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers *headers.Headers
+	// Body is sent with ContentLength bytes, or chunked when the length
+	// is -1
+	Body          io.Reader
+	ContentLength int64
+	// Trailers follow a chunked body. They are only read once the body
+	// has been sent, so they can be filled in while it streams.
+	Trailers *headers.Headers
+
+	ctx context.Context
+}
+
+// NewRequest creates a request for rawURL. The length of body is known
+// for byte and string readers, any other body is sent chunked.
+func NewRequest(method, rawURL string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ERROR_UNSUPPORTED_SCHEME
+	}
+
+	req := &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Reader:
+		req.ContentLength = int64(b.Len())
+	case *bytes.Buffer:
+		req.ContentLength = int64(b.Len())
+	case *strings.Reader:
+		req.ContentLength = int64(b.Len())
+	default:
+		req.ContentLength = -1
+	}
+
+	return req, nil
+}
+
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a copy of r that is abandoned once ctx is done.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	copy := *r
+	copy.ctx = ctx
+	return &copy
+}
+
+// replayable reports whether the request can be sent again as it is.
+func (r *Request) replayable() bool {
+	return (r.Body == nil || r.ContentLength == 0) && request.IsIdempotent(r.Method)
+}
+
+func (r *Request) host() string {
+	if host, ok := r.Headers.Get("host"); ok {
+		return host
+	}
+	return r.URL.Host
+}
+
+// Fields the client writes itself from the request's framing
+var framingFields = map[string]bool{
+	"host":              true,
+	"content-length":    true,
+	"transfer-encoding": true,
+}
+
+func (r *Request) write(w *bufio.Writer) error {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", r.Method, r.URL.RequestURI())
+	fmt.Fprintf(w, "Host: %s\r\n", r.host())
+
+	r.Headers.Lines(func(name, value string) error {
+		if !framingFields[name] {
+			fmt.Fprintf(w, "%s: %s\r\n", name, value)
+		}
+		return nil
+	})
+
+	hasBody := r.Body != nil && r.ContentLength != 0
+	switch {
+	case hasBody && r.ContentLength > 0:
+		fmt.Fprintf(w, "Content-Length: %d\r\n", r.ContentLength)
+	case hasBody:
+		w.WriteString("Transfer-Encoding: chunked\r\n")
+	case r.Method == request.MethodPost || r.Method == request.MethodPut || r.Method == request.MethodPatch:
+		// These methods usually carry a body, say there is none
+		w.WriteString("Content-Length: 0\r\n")
+	}
+	w.WriteString("\r\n")
+
+	if !hasBody {
+		return w.Flush()
+	}
+
+	if r.ContentLength > 0 {
+		n, err := io.CopyN(w, r.Body, r.ContentLength)
+		if err == io.EOF || n < r.ContentLength {
+			return ERROR_BODY_TOO_SHORT
+		}
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	if err := writeChunked(w, r.Body); err != nil {
+		return err
+	}
+	w.WriteString("0\r\n")
+	if r.Trailers != nil {
+		r.Trailers.Lines(func(name, value string) error {
+			fmt.Fprintf(w, "%s: %s\r\n", name, value)
+			return nil
+		})
+	}
+	w.WriteString("\r\n")
+	return w.Flush()
+}
+
+// writeChunked sends body as one chunk per read, flushing each so a
+// streamed body reaches the server as it is produced.
+func writeChunked(w *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			w.WriteString(strconv.FormatInt(int64(n), 16))
+			w.WriteString("\r\n")
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+			if ferr := w.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"sync"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+type Response struct {
+	StatusCode  int
+	Reason      string
+	HttpVersion string
+	Headers     headers.Headers
+	// ContentLength is -1 when the body runs until the connection closes
+	// or is chunked
+	ContentLength int64
+	// Body must be closed. Close returns once a request body still being
+	// sent is no longer read.
+	Body io.ReadCloser
+	// Trailers sent after a chunked body, filled in once it is read
+	Trailers headers.Headers
+
+	Request   *Request
+	keepAlive bool
+	// there is no body to read before the connection can be reused
+	empty bool
+}
+
+// readResponse reads the final response to a request and sets up its body.
+func readResponse(br *bufio.Reader, method string) (*Response, error) {
+	parsed, err := response.ReadResponse(br, method)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Response{
+		StatusCode:    int(parsed.StatusLine.StatusCode),
+		Reason:        parsed.StatusLine.ReasonPhrase,
+		HttpVersion:   parsed.StatusLine.HttpVersion,
+		Headers:       parsed.Headers,
+		ContentLength: parsed.ContentLength(),
+		Body:          io.NopCloser(parsed.BodyReader()),
+		Trailers:      parsed.Trailers,
+		keepAlive:     parsed.KeepAlive(),
+		empty:         !parsed.HasBody(),
+	}
+
+	switch {
+	// The connection now carries another protocol, which the caller reads
+	// from the body until it closes
+	case resp.StatusCode == int(response.StatusSwitchingProtocols) ||
+		method == request.MethodConnect && parsed.Bodiless():
+		resp.ContentLength = -1
+		resp.Body = io.NopCloser(br)
+		resp.keepAlive = false
+		resp.empty = false
+	// HEAD tells the length a GET would have got
+	case method == request.MethodHead:
+		if length, ok := resp.Headers.Get("content-length"); ok {
+			if n, err := strconv.ParseInt(length, 10, 64); err == nil {
+				resp.ContentLength = n
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// the body has been read.
+func (r *Response) KeepAlive() bool {
+	return r.keepAlive
+}
+
+// body hands the connection back once the response has been read to the
+// end, and gives it up when closed early.
+type body struct {
+	src  io.ReadCloser
+	once sync.Once
+	// done is called with whether the connection may be reused
+	done func(reuse bool)
+	// wait returns once the request body is no longer being read
+	wait func()
+}
+
+func (b *body) finish(reuse bool) {
+	b.once.Do(func() { b.done(reuse) })
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if err == io.EOF {
+		b.finish(true)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Close also waits for the request body to be let go of, as it is the
+// caller's again afterwards.
+func (b *body) Close() error {
+	b.finish(false)
+	b.wait()
+	return nil
+}
@@ -0,0 +1,215 @@
+package cookie
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.serve/internal/headers"
+)
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = 0
+	SameSiteLax     SameSite = 1
+	SameSiteStrict  SameSite = 2
+	SameSiteNone    SameSite = 3
+)
+
+var sameSiteName = map[SameSite]string{
+	SameSiteLax:    "Lax",
+	SameSiteStrict: "Strict",
+	SameSiteNone:   "None",
+}
+
+func (s SameSite) String() string {
+	return sameSiteName[s]
+}
+
+// Cookie is a single cookie as sent by a client in the Cookie header or
+// set by the server with Set-Cookie (RFC 6265).
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge == 0 leaves the attribute out, MaxAge < 0 deletes the cookie
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+var ERROR_INVALID_COOKIE_NAME = fmt.Errorf("Invalid cookie name")
+var ERROR_INVALID_COOKIE_VALUE = fmt.Errorf("Invalid cookie value")
+var ERROR_INVALID_COOKIE_PATH = fmt.Errorf("Invalid cookie path")
+var ERROR_INVALID_COOKIE_DOMAIN = fmt.Errorf("Invalid cookie domain")
+var ERROR_COOKIE_NOT_SECURE = fmt.Errorf("SameSite=None and Partitioned cookies must be Secure")
+var ERROR_NO_COOKIE = fmt.Errorf("Named cookie not present")
+
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+func ValidName(name string) bool {
+	return headers.IsToken([]byte(name))
+}
+
+// cookie-octet from RFC 6265 section 4.1.1
+func isCookieOctet(ch byte) bool {
+	return ch == 0x21 ||
+		ch >= 0x23 && ch <= 0x2B ||
+		ch >= 0x2D && ch <= 0x3A ||
+		ch >= 0x3C && ch <= 0x5B ||
+		ch >= 0x5D && ch <= 0x7E
+}
+
+func ValidValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Path and Domain may hold any CHAR except CTLs and ';'
+func validAttribute(value string) bool {
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		if ch < 0x20 || ch >= 0x7F || ch == ';' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			ch := label[i]
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (c *Cookie) Valid() error {
+	if !ValidName(c.Name) {
+		return ERROR_INVALID_COOKIE_NAME
+	}
+
+	if !ValidValue(c.Value) {
+		return ERROR_INVALID_COOKIE_VALUE
+	}
+
+	if !validAttribute(c.Path) {
+		return ERROR_INVALID_COOKIE_PATH
+	}
+
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return ERROR_INVALID_COOKIE_DOMAIN
+	}
+
+	if (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure {
+		return ERROR_COOKIE_NOT_SECURE
+	}
+
+	return nil
+}
+
+// String serializes the cookie for use in a Set-Cookie header. The cookie
+// must be checked with Valid first.
+func (c *Cookie) String() string {
+	var b strings.Builder
+
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	b.WriteString(c.Value)
+
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=")
+		b.WriteString(strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=")
+		b.WriteString(c.Expires.UTC().Format(timeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=")
+		b.WriteString(c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+
+	return b.String()
+}
+
+// Parse reads the name=value pairs of a Cookie request header. Pairs with
+// an invalid name or value are skipped.
+func Parse(header string) []*Cookie {
+	cookies := []*Cookie{}
+
+	for _, pair := range strings.Split(header, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(pair, "=")
+		if !found || !ValidName(name) || !ValidValue(value) {
+			continue
+		}
+
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		cookies = append(cookies, &Cookie{
+			Name:  name,
+			Value: value,
+		})
+	}
+
+	return cookies
+}
@@ -0,0 +1,64 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieParse(t *testing.T) {
+	// Test: Multiple cookies
+	cookies := Parse("session=abc123; theme=dark;lang=\"en\"")
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "theme", cookies[1].Name)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "en", cookies[2].Value)
+
+	// Test: Invalid pairs are skipped
+	cookies = Parse("bad name=1; good=2; novalue; quote=a\"b")
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "good", cookies[0].Name)
+
+	// Test: Empty header
+	cookies = Parse("")
+	assert.Len(t, cookies, 0)
+}
+
+func TestCookieString(t *testing.T) {
+	// Test: All attributes
+	c := &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=a3fWa; Path=/; Domain=example.com; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=None; Partitioned", c.String())
+
+	// Test: Negative MaxAge deletes the cookie
+	c = &Cookie{Name: "id", MaxAge: -1}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=; Max-Age=0", c.String())
+}
+
+func TestCookieValid(t *testing.T) {
+	assert.Equal(t, ERROR_INVALID_COOKIE_NAME, (&Cookie{Name: ""}).Valid())
+	assert.Equal(t, ERROR_INVALID_COOKIE_NAME, (&Cookie{Name: "a=b"}).Valid())
+	assert.Equal(t, ERROR_INVALID_COOKIE_VALUE, (&Cookie{Name: "a", Value: "b c"}).Valid())
+	assert.Equal(t, ERROR_INVALID_COOKIE_VALUE, (&Cookie{Name: "a", Value: "b;c"}).Valid())
+	assert.Equal(t, ERROR_INVALID_COOKIE_PATH, (&Cookie{Name: "a", Path: "/;x"}).Valid())
+	assert.Equal(t, ERROR_INVALID_COOKIE_DOMAIN, (&Cookie{Name: "a", Domain: "exa mple.com"}).Valid())
+	assert.Equal(t, ERROR_COOKIE_NOT_SECURE, (&Cookie{Name: "a", SameSite: SameSiteNone}).Valid())
+	assert.Equal(t, ERROR_COOKIE_NOT_SECURE, (&Cookie{Name: "a", Partitioned: true}).Valid())
+	assert.NoError(t, (&Cookie{Name: "a", Value: "\"quoted\""}).Valid())
+}
@@ -6,7 +6,11 @@ import (
 	"strings"
 )
 
-func isToken(str []byte) bool {
+func IsToken(str []byte) bool {
+	if len(str) == 0 {
+		return false
+	}
+
 	for _, ch := range str {
 		found := false
 		if ch >= 'A' && ch <= 'Z' ||
@@ -27,71 +31,230 @@ func isToken(str []byte) bool {
 	return true
 }
 
+// Fields that cannot be folded into a single comma separated line and
+// must be written once per value instead.
+var multiLineFields = map[string]bool{
+	"set-cookie": true,
+}
+
+type field struct {
+	// always lower case
+	name  string
+	value string
+}
+
+// Headers keeps the fields in the order they were added. Like a map, the
+// fields are shared by copies of a Headers, which is how trailers read
+// after a request was copied still reach the handler. The zero value is
+// an empty set ready to use, but copies of it only share fields once one
+// has been added.
 type Headers struct {
-	headers map[string]string
+	fields *[]field
 }
 
 func NewHeaders() *Headers {
-	return &Headers{
-		headers: map[string]string{},
+	return &Headers{fields: &[]field{}}
+}
+
+func (h *Headers) list() []field {
+	if h.fields == nil {
+		return nil
 	}
+	return *h.fields
 }
 
 var MALFORMED_FIELD_LINE = fmt.Errorf("Malformed Field Line")
 var MALFORMED_FIELD_NAME = fmt.Errorf("Malformed Field Name")
 
-func parseHeader(fieldLine []byte) (string, string, error) {
-	parts := bytes.SplitN(fieldLine, []byte(":"), 2)
-	if len(parts) != 2 {
+// parseHeader splits a field line into its name and value. The name is
+// taken as it is: whitespace before it would be an obsolete line folding
+// and whitespace before the colon is not allowed either (RFC 9112 section
+// 5), and a proxy that reads such a line differently could be sent a field
+// we never saw. For the same reason the value can't hold control
+// characters, a bare CR or LF above all, and only spaces and tabs are
+// trimmed around it.
+func parseHeader(fieldLine string) (string, string, error) {
+	name, value, found := strings.Cut(fieldLine, ":")
+	if !found {
 		return "", "", MALFORMED_FIELD_LINE
 	}
 
-	if bytes.HasSuffix(parts[0], []byte(" ")) {
+	if !IsToken([]byte(name)) {
 		return "", "", MALFORMED_FIELD_NAME
 	}
 
-	name := bytes.TrimSpace(parts[0])
-	value := bytes.TrimSpace(parts[1])
+	value = strings.Trim(value, " \t")
+	for i := 0; i < len(value); i++ {
+		if ch := value[i]; ch < ' ' && ch != '\t' || ch == 0x7f {
+			return "", "", MALFORMED_FIELD_LINE
+		}
+	}
 
-	return string(name), string(value), nil
+	return name, value, nil
 }
 
 var SEPARATOR = []byte("\r\n")
 
+// equalLower compares a field name with name, which may be in any case.
+func equalLower(lower, name string) bool {
+	if len(lower) != len(name) {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if ch >= 'A' && ch <= 'Z' {
+			ch += 'a' - 'A'
+		}
+		if lower[i] != ch {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetAll returns every field with repeated values joined by commas.
 func (h *Headers) GetAll() map[string]string {
-	return h.headers
+	all := make(map[string]string, len(h.list()))
+	for _, f := range h.list() {
+		if _, ok := all[f.name]; !ok {
+			all[f.name], _ = h.Get(f.name)
+		}
+	}
+
+	return all
 }
 
 func (h *Headers) Get(name string) (string, bool) {
-	str, ok := h.headers[strings.ToLower(name)]
+	found := -1
+	for i, f := range h.list() {
+		if !equalLower(f.name, name) {
+			continue
+		}
+
+		// Repeated fields are rare, so only they pay for the join
+		if found != -1 {
+			return strings.Join(h.Values(name), ","), true
+		}
+		found = i
+	}
 
-	return str, ok
+	if found == -1 {
+		return "", false
+	}
+	return h.list()[found].value, true
 }
 
-func (h *Headers) Set(name, value string) {
-	name = strings.ToLower(name)
+// Values returns each value set for name in the order they were added.
+func (h *Headers) Values(name string) []string {
+	var values []string
+	for _, f := range h.list() {
+		if equalLower(f.name, name) {
+			values = append(values, f.value)
+		}
+	}
+
+	return values
+}
+
+// HasToken reports whether token is one of the comma separated values of
+// name, ignoring case, as used by Connection and Transfer-Encoding.
+func (h *Headers) HasToken(name, token string) bool {
+	for _, f := range h.list() {
+		if !equalLower(f.name, name) {
+			continue
+		}
 
-	if v, ok := h.headers[name]; ok {
-		h.headers[name] = fmt.Sprintf("%s,%s", v, value)
-	} else {
-		h.headers[name] = value
+		rest := f.value
+		for rest != "" {
+			var t string
+			t, rest, _ = strings.Cut(rest, ",")
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
 	}
+
+	return false
+}
+
+func (h *Headers) Set(name, value string) {
+	if h.fields == nil {
+		h.fields = &[]field{}
+	}
+	*h.fields = append(*h.fields, field{name: lower(name), value: value})
 }
 
 func (h *Headers) Replace(name, value string) {
-	name = strings.ToLower(name)
+	h.Delete(name)
+	h.Set(name, value)
+}
 
-	if _, ok := h.headers[name]; ok {
-		h.headers[name] = value
-	} else {
-		h.Set(name, value)
+func (h *Headers) Delete(name string) {
+	fields := h.list()
+	kept := fields[:0]
+	for _, f := range fields {
+		if !equalLower(f.name, name) {
+			kept = append(kept, f)
+		}
+	}
+
+	// Don't keep the removed values alive
+	clear(fields[len(kept):])
+	if h.fields != nil {
+		*h.fields = kept
 	}
 }
 
-func (h *Headers) Delete(name string) {
-	if _, ok := h.headers[name]; ok {
-		delete(h.headers, name)
+// Reset removes every field but keeps the storage, so a parser reading
+// one request after another doesn't allocate it again.
+func (h *Headers) Reset() {
+	if h.fields == nil {
+		return
+	}
+
+	clear(*h.fields)
+	*h.fields = (*h.fields)[:0]
+}
+
+// Clone returns a copy that can be changed without affecting h.
+func (h *Headers) Clone() *Headers {
+	fields := append([]field(nil), h.list()...)
+	return &Headers{fields: &fields}
+}
+
+// Lines calls fn once for every field line that should be written,
+// splitting fields such as Set-Cookie that cannot be combined.
+func (h *Headers) Lines(fn func(name, value string) error) error {
+	fields := h.list()
+	for i, f := range fields {
+		if multiLineFields[f.name] {
+			if err := fn(f.name, f.value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Repeated fields go out once, joined, where they first appeared
+		first := true
+		for _, earlier := range fields[:i] {
+			if earlier.name == f.name {
+				first = false
+				break
+			}
+		}
+		if !first {
+			continue
+		}
+
+		value, _ := h.Get(f.name)
+		if err := fn(f.name, value); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
 func (h *Headers) Parse(data []byte) (int, bool, error) {
@@ -112,18 +275,43 @@ func (h *Headers) Parse(data []byte) (int, bool, error) {
 			break
 		}
 
-		name, value, err := parseHeader(data[read : read+idx])
+		name, value, err := parseHeader(string(data[read : read+idx]))
 		if err != nil {
 			return 0, done, err
 		}
 
-		if !isToken([]byte(name)) {
-			return 0, false, MALFORMED_FIELD_NAME
-		}
-
 		read += idx + len(SEPARATOR)
 		h.Set(name, value)
 	}
 
 	return read, done, nil
 }
+
+// ParseFieldLines parses a complete field section, up to and including
+// the empty line that ends it. The names and values are substrings of
+// section rather than copies, so a request head read into one string
+// costs no further allocations.
+func (h *Headers) ParseFieldLines(section string) error {
+	if h.fields == nil {
+		fields := make([]field, 0, max(strings.Count(section, "\r\n")-1, 0))
+		h.fields = &fields
+	}
+
+	for {
+		line, rest, found := strings.Cut(section, "\r\n")
+		if !found {
+			return MALFORMED_FIELD_LINE
+		}
+		if line == "" {
+			return nil
+		}
+
+		name, value, err := parseHeader(line)
+		if err != nil {
+			return err
+		}
+
+		h.Set(name, value)
+		section = rest
+	}
+}
@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -29,7 +30,7 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, "localhost:42069", s)
 	s, _ = headers.Get("Content-Type")
 	assert.Equal(t, "application/json", s)
-	s, _ = headers.Get("Content-Type")
+	s, _ = headers.Get("Content-Length")
 	assert.Equal(t, "42069", s)
 	assert.Equal(t, 80, n)
 	assert.True(t, done)
@@ -63,4 +64,166 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
+	// Test: Invalid - obsolete line folding and control characters
+	for _, data := range []string{
+		"Host: x\r\n Transfer-Encoding: chunked\r\n\r\n",
+		"Transfer-Encoding\t: chunked\r\n\r\n",
+		"X: a\nContent-Length: 5\r\n\r\n",
+		"X: a\rb\r\n\r\n",
+		"X: a\x00\r\n\r\n",
+	} {
+		_, _, err = NewHeaders().Parse([]byte(data))
+		assert.Error(t, err, "%q", data)
+	}
+}
+
+func TestHeaderMultiLineFields(t *testing.T) {
+	// Test: Set-Cookie values are written on separate lines
+	headers := NewHeaders()
+	headers.Set("Set-Cookie", "a=1")
+	headers.Set("Set-Cookie", "b=2")
+	headers.Set("Vary", "Accept")
+	headers.Set("Vary", "Cookie")
+	assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("set-cookie"))
+
+	lines := map[string][]string{}
+	err := headers.Lines(func(name, value string) error {
+		lines[name] = append(lines[name], value)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1", "b=2"}, lines["set-cookie"])
+	assert.Equal(t, []string{"Accept,Cookie"}, lines["vary"])
+
+	// Test: Delete is case insensitive
+	headers.Delete("SET-COOKIE")
+	_, ok := headers.Get("set-cookie")
+	assert.False(t, ok)
+}
+
+func TestHeaderFieldLines(t *testing.T) {
+	// Test: A complete section, names in any case
+	headers := NewHeaders()
+	require.NoError(t, headers.ParseFieldLines("Host: example.com\r\nX-Custom-Thing:  a \r\nACCEPT: */*\r\n\r\n"))
+	s, _ := headers.Get("host")
+	assert.Equal(t, "example.com", s)
+	s, _ = headers.Get("X-CUSTOM-THING")
+	assert.Equal(t, "a", s)
+	assert.Equal(t, []string{"*/*"}, headers.Values("Accept"))
+
+	// Test: The section must end with an empty line
+	headers = NewHeaders()
+	assert.ErrorIs(t, headers.ParseFieldLines("Host: example.com\r\n"), MALFORMED_FIELD_LINE)
+	assert.ErrorIs(t, headers.ParseFieldLines("Ho st: example.com\r\n\r\n"), MALFORMED_FIELD_NAME)
+
+	// Test: Lines come out in the order fields were added, repeated ones
+	// joined where they first appeared
+	headers = NewHeaders()
+	headers.Set("B", "1")
+	headers.Set("A", "2")
+	headers.Set("b", "3")
+	lines := []string{}
+	headers.Lines(func(name, value string) error {
+		lines = append(lines, name+": "+value)
+		return nil
+	})
+	assert.Equal(t, []string{"b: 1,3", "a: 2"}, lines)
+
+	// Test: Copies share the fields, like a map would
+	var zero Headers
+	zero.Set("x-one", "1")
+	copied := zero
+	zero.Set("x-two", "2")
+	_, ok := copied.Get("x-two")
+	assert.True(t, ok)
+
+	clone := zero.Clone()
+	clone.Replace("x-one", "changed")
+	s, _ = zero.Get("x-one")
+	assert.Equal(t, "1", s)
+}
+
+func TestLowerNames(t *testing.T) {
+	assert.Equal(t, "content-type", lower("Content-Type"))
+	assert.Equal(t, "x-custom", lower("X-Custom"))
+	assert.Equal(t, "host", lower("host"))
+
+	// Test: Common names don't allocate
+	allocs := testing.AllocsPerRun(100, func() {
+		lower("User-Agent")
+		lower("accept")
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func fieldLines(h *Headers) string {
+	var sb strings.Builder
+	h.Lines(func(name, value string) error {
+		sb.WriteString(name + ": " + value + "\r\n")
+		return nil
+	})
+	return sb.String()
+}
+
+func FuzzHeadersParse(f *testing.F) {
+	for _, seed := range []string{
+		"Host: localhost:42069\r\n\r\n",
+		"HoSt: localhost:42069\r\nContent-Type: application/json\r\nContent-Length: 42069\r\n\r\n",
+		"Set-Cookie: a=1\r\nSet-Cookie: b=2\r\nAccept: a\r\nAccept: b\r\n\r\n",
+		"Host: x\r\nPartial: val",
+		"\t  \t Host : localhost:24069\t   \t     \r\n\r\n",
+		"Host: x\r\n Transfer-Encoding: chunked\r\n\r\n",
+		"Transfer-Encoding\t: chunked\r\n\r\n",
+		"X: a\nContent-Length: 5\r\n\r\n",
+		"X: a\rContent-Length: 5\r\n\r\n",
+		"X: \x00\r\n\r\n",
+		"X: caf\xc3\xa9\r\n\r\n",
+		"X:\r\n\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewHeaders()
+		n, done, err := h.Parse(data)
+		if err != nil {
+			return
+		}
+		if n > len(data) {
+			t.Fatalf("%q: read %d of %d bytes", data, n, len(data))
+		}
+
+		lines := fieldLines(h)
+		for _, line := range strings.Split(strings.TrimSuffix(lines, "\r\n"), "\r\n") {
+			name, value, _ := strings.Cut(line, ": ")
+			if name != strings.ToLower(name) {
+				t.Errorf("%q: name %q isn't lower case", data, name)
+			}
+			if strings.ContainsAny(value, "\r\n\x00") {
+				t.Errorf("%q: value %q could split the line it is written on", data, value)
+			}
+		}
+
+		// What is written out reads back the same
+		again := NewHeaders()
+		if err := again.ParseFieldLines(lines + "\r\n"); err != nil {
+			t.Fatalf("%q: wrote %q which doesn't parse: %v", data, lines, err)
+		}
+		if fieldLines(again) != lines {
+			t.Errorf("%q: wrote %q, read back %q", data, lines, fieldLines(again))
+		}
+
+		if !done {
+			return
+		}
+
+		// Both parsers agree on a complete section
+		views := NewHeaders()
+		if err := views.ParseFieldLines(string(data[:n])); err != nil {
+			t.Fatalf("%q: Parse succeeded, ParseFieldLines failed: %v", data, err)
+		}
+		if fieldLines(views) != lines {
+			t.Errorf("%q: Parse read %q, ParseFieldLines %q", data, lines, fieldLines(views))
+		}
+	})
 }
@@ -0,0 +1,60 @@
+package headers
+
+import "strings"
+
+// Field names common enough in requests that their lower case form is
+// kept once rather than made anew for every request.
+var commonNames = map[string]string{}
+
+func init() {
+	for _, name := range []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-digest", "content-encoding",
+		"content-length", "content-md5", "content-type", "cookie", "dnt",
+		"expect", "forwarded", "host", "if-match", "if-modified-since",
+		"if-none-match", "if-range", "keep-alive", "last-event-id", "origin",
+		"pragma", "priority", "range", "referer", "sec-fetch-dest",
+		"sec-fetch-mode", "sec-fetch-site", "sec-fetch-user",
+		"sec-websocket-extensions", "sec-websocket-key",
+		"sec-websocket-protocol", "sec-websocket-version", "te", "trailer",
+		"transfer-encoding", "upgrade", "upgrade-insecure-requests",
+		"user-agent", "via", "want-content-digest", "want-repr-digest",
+		"x-forwarded-for", "x-forwarded-host", "x-forwarded-proto",
+		"x-real-ip", "x-request-id",
+	} {
+		commonNames[name] = name
+	}
+}
+
+// lower returns name in lower case, the form fields are stored in. Names
+// that are already lower case are returned as they are, common ones come
+// from a table, so neither allocates.
+func lower(name string) string {
+	upper := false
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 'A' && name[i] <= 'Z' {
+			upper = true
+			break
+		}
+	}
+	if !upper {
+		return name
+	}
+
+	var buf [32]byte
+	if len(name) <= len(buf) {
+		b := buf[:len(name)]
+		for i := 0; i < len(name); i++ {
+			ch := name[i]
+			if ch >= 'A' && ch <= 'Z' {
+				ch += 'a' - 'A'
+			}
+			b[i] = ch
+		}
+		if common, ok := commonNames[string(b)]; ok {
+			return common
+		}
+	}
+
+	return strings.ToLower(name)
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+type TunnelOptions struct {
+	// Allow lists the destinations clients may connect to, see rule for
+	// the syntax. An empty list refuses everything; "*" allows everything
+	// not denied.
+	Allow []string
+	// Deny lists destinations that are always refused. IP and prefix
+	// rules are also checked against the address a name resolves to.
+	Deny []string
+	// DialTimeout bounds connecting to the destination, defaults to 10s
+	DialTimeout time.Duration
+}
+
+// Tunnel answers CONNECT requests (RFC 9110 section 9.3.6) by opening a
+// TCP connection to the requested host and relaying bytes both ways, which
+// makes the server an HTTPS forward proxy.
+type Tunnel struct {
+	allow  []rule
+	deny   []rule
+	dialer net.Dialer
+}
+
+func NewTunnel(opts TunnelOptions) (*Tunnel, error) {
+	allow, err := parseRules(opts.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseRules(opts.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := opts.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	return &Tunnel{
+		allow:  allow,
+		deny:   deny,
+		dialer: net.Dialer{Timeout: timeout},
+	}, nil
+}
+
+// allowedName checks the destination as the client named it. It also
+// reports whether an allow rule matched, so the resolved address doesn't
+// need to.
+func (t *Tunnel) allowedName(host string, port int) (allowed bool, byName bool) {
+	for _, r := range t.deny {
+		if r.matchName(host, port) {
+			return false, false
+		}
+	}
+
+	if len(t.allow) == 0 {
+		return false, false
+	}
+	for _, r := range t.allow {
+		if r.matchName(host, port) {
+			return true, true
+		}
+	}
+
+	// An address rule may still match once the name is resolved
+	return true, false
+}
+
+// allowedAddr checks the address we are about to connect to, so a name
+// can't be used to reach a denied network.
+func (t *Tunnel) allowedAddr(address string, byName bool) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return ERROR_DESTINATION_NOT_ALLOWED
+	}
+	addr, port := addrPort.Addr(), int(addrPort.Port())
+
+	for _, r := range t.deny {
+		if r.matchAddr(addr, port) {
+			return ERROR_DESTINATION_NOT_ALLOWED
+		}
+	}
+
+	if byName {
+		return nil
+	}
+	for _, r := range t.allow {
+		if r.matchAddr(addr, port) {
+			return nil
+		}
+	}
+	return ERROR_DESTINATION_NOT_ALLOWED
+}
+
+func (t *Tunnel) dial(ctx context.Context, authority string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(authority)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, byName := t.allowedName(host, port)
+	if !allowed {
+		return nil, ERROR_DESTINATION_NOT_ALLOWED
+	}
+
+	dialer := t.dialer
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		return t.allowedAddr(address, byName)
+	}
+
+	return dialer.DialContext(ctx, "tcp", authority)
+}
+
+func reply(w *response.Writer, status response.StatusCode) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+}
+
+// Serve is a Handler for CONNECT requests.
+func (t *Tunnel) Serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != request.MethodConnect {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Allow", request.MethodConnect)
+		w.WriteStatusLine(response.StatusMethodNotAllowed)
+		w.WriteHeaders(h)
+		return
+	}
+
+	upstream, err := t.dial(req.Context(), req.Target.Authority)
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.Is(err, ERROR_DESTINATION_NOT_ALLOWED):
+			reply(w, response.StatusForbidden)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			reply(w, response.StatusGatewayTimeout)
+		default:
+			reply(w, response.StatusBadGateway)
+		}
+		return
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		reply(w, response.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	// A 2xx answer to CONNECT has no body, the tunnel starts right after
+	// the blank line
+	status := "HTTP/1.1 200 Connection Established\r\n\r\n"
+	if _, err := conn.Write([]byte(status)); err != nil {
+		return
+	}
+
+	// Bytes the client sent before seeing our answer
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	relay(conn, upstream)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies in both directions until both sides are done. When one
+// side stops sending, the other is told by closing our write half, so it
+// can still finish its answer.
+func relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+
+		// Without a clean end there is nothing left to wait for
+		a.Close()
+		b.Close()
+	}
+
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/server"
+)
+
+// echoServer copies everything back and closes its write half once the
+// client is done sending.
+func echoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
+
+func startTunnel(t *testing.T, opts TunnelOptions) net.Addr {
+	tunnel, err := NewTunnel(opts)
+	require.NoError(t, err)
+
+	s, err := server.Serve(0, tunnel.Serve)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s.Addr()
+}
+
+func connect(t *testing.T, proxy net.Addr, target, early string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", proxy.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n%s", target, target, early)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	return conn, br, status
+}
+
+func TestTunnel(t *testing.T) {
+	echo := echoServer(t)
+	proxy := startTunnel(t, TunnelOptions{Allow: []string{"127.0.0.1"}})
+
+	// Test: Bytes sent with the request and after the reply are relayed
+	conn, br, status := connect(t, proxy, echo.String(), "early ")
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	blank, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", blank)
+
+	_, err = conn.Write([]byte("late"))
+	require.NoError(t, err)
+
+	// Test: Half-close reaches the destination, whose answer still
+	// comes back before the tunnel ends
+	conn.(*net.TCPConn).CloseWrite()
+	out, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(out))
+}
+
+func TestTunnelRules(t *testing.T) {
+	echo := echoServer(t)
+	port := echo.Port
+
+	// Test: Without an allow list nothing is reached
+	proxy := startTunnel(t, TunnelOptions{})
+	_, _, status := connect(t, proxy, echo.String(), "")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden \r\n", status)
+
+	// Test: Denied address
+	proxy = startTunnel(t, TunnelOptions{Allow: []string{"*"}, Deny: []string{"127.0.0.0/8", "::1"}})
+	_, _, status = connect(t, proxy, echo.String(), "")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden \r\n", status)
+
+	// Test: A name resolving to a denied network is refused too
+	_, _, status = connect(t, proxy, fmt.Sprintf("localhost:%d", port), "")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden \r\n", status)
+
+	// Test: Port not on the allow list
+	proxy = startTunnel(t, TunnelOptions{Allow: []string{"*:443"}})
+	_, _, status = connect(t, proxy, echo.String(), "")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden \r\n", status)
+
+	// Test: Name allowed by wildcard and port range
+	proxy = startTunnel(t, TunnelOptions{Allow: []string{fmt.Sprintf("*.example.com:%d-%d", port, port), "localhost"}})
+	_, _, status = connect(t, proxy, fmt.Sprintf("localhost:%d", port), "")
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+
+	// Test: Nothing listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+	proxy = startTunnel(t, TunnelOptions{Allow: []string{"127.0.0.1"}})
+	_, _, status = connect(t, proxy, closed, "")
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway \r\n", status)
+
+	// Test: Only CONNECT is served
+	conn, err := net.Dial("tcp", proxy.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	status, _ = bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed \r\n", status)
+}
+
+func TestRules(t *testing.T) {
+	r, err := parseRule("*.example.com:443")
+	require.NoError(t, err)
+	assert.True(t, r.matchName("api.example.com", 443))
+	assert.True(t, r.matchName("API.Example.com.", 443))
+	assert.False(t, r.matchName("example.com", 443))
+	assert.False(t, r.matchName("api.example.com", 80))
+
+	r, err = parseRule("10.0.0.0/8:8000-9000")
+	require.NoError(t, err)
+	assert.True(t, r.matchName("10.1.2.3", 8080))
+	assert.False(t, r.matchName("10.1.2.3", 443))
+	assert.False(t, r.matchName("ten.example.com", 8080))
+
+	r, err = parseRule("[::1]:22")
+	require.NoError(t, err)
+	assert.True(t, r.matchName("::1", 22))
+
+	r, err = parseRule("fd00::/8")
+	require.NoError(t, err)
+	assert.True(t, r.matchName("fd12::1", 1))
+
+	r, err = parseRule("*")
+	require.NoError(t, err)
+	assert.True(t, r.matchName("anything", 1))
+
+	// Test: Malformed rules
+	for _, s := range []string{"", "host:http", "host:90-80", "host:70000", "10.0.0.0/33"} {
+		_, err = parseRules([]string{s})
+		assert.ErrorIs(t, err, ERROR_INVALID_RULE, s)
+	}
+	_, err = NewTunnel(TunnelOptions{Deny: []string{"x:y"}})
+	assert.True(t, strings.Contains(err.Error(), `"x:y"`))
+}
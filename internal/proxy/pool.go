@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.serve/internal/client"
+	"go.serve/internal/request"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultMaxFails       = 3
+	defaultEjectFor       = 30 * time.Second
+	// Points per backend on the hash ring, more spread keys more evenly
+	hashReplicas = 100
+)
+
+var ERROR_NO_UPSTREAMS = fmt.Errorf("At least one upstream is required")
+
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConnections
+	// ConsistentHash sends requests with the same key to the same backend
+	// for as long as it is available
+	ConsistentHash
+)
+
+type PoolOptions struct {
+	// Upstreams are base URLs as in ReverseOptions.Upstream
+	Upstreams []string
+	Strategy  Strategy
+	// HashHeader or HashCookie names where ConsistentHash finds its key.
+	// Without either, or when the request has none, the client's IP is
+	// used.
+	HashHeader string
+	HashCookie string
+
+	// HealthPath is requested on every backend each HealthInterval (10s
+	// by default). A backend answering with anything but 2xx or 3xx, or
+	// not within HealthTimeout (2s), gets no traffic until it recovers.
+	// Empty disables active checks.
+	HealthPath     string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	// MaxFails connection errors or 5xx responses in a row eject a
+	// backend for EjectFor. Defaults to 3 and 30s.
+	MaxFails int
+	EjectFor time.Duration
+
+	// Retries is how many other backends an idempotent request without a
+	// body is tried on when a backend fails
+	Retries int
+}
+
+type backend struct {
+	url *url.URL
+	// requests in flight, for LeastConnections
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+}
+
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// Pool spreads requests over several upstreams, keeping track of which are
+// fit to receive them.
+type Pool struct {
+	opts     PoolOptions
+	backends []*backend
+	ring     []ringPoint
+	next     atomic.Uint64
+
+	health *client.Client
+	stop   context.CancelFunc
+	now    func() time.Time
+}
+
+func NewPool(opts PoolOptions) (*Pool, error) {
+	if len(opts.Upstreams) == 0 {
+		return nil, ERROR_NO_UPSTREAMS
+	}
+
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = defaultHealthInterval
+	}
+	if opts.HealthTimeout <= 0 {
+		opts.HealthTimeout = defaultHealthTimeout
+	}
+	if opts.MaxFails <= 0 {
+		opts.MaxFails = defaultMaxFails
+	}
+	if opts.EjectFor <= 0 {
+		opts.EjectFor = defaultEjectFor
+	}
+
+	p := &Pool{
+		opts:   opts,
+		health: client.NewClient(client.Options{Timeout: opts.HealthTimeout, MaxRedirects: -1}),
+		now:    time.Now,
+	}
+
+	for _, upstream := range opts.Upstreams {
+		u, err := parseUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+		b := &backend{url: u, healthy: true}
+		p.backends = append(p.backends, b)
+
+		for i := 0; i < hashReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{
+				hash:    crc32.ChecksumIEEE([]byte(upstream + "#" + strconv.Itoa(i))),
+				backend: b,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	ctx, stop := context.WithCancel(context.Background())
+	p.stop = stop
+	if opts.HealthPath != "" {
+		go p.checkHealth(ctx)
+	}
+
+	return p, nil
+}
+
+// Close stops the health checks.
+func (p *Pool) Close() {
+	p.stop()
+	p.health.CloseIdle()
+}
+
+// pick chooses a backend for req that is available and not in tried.
+func (p *Pool) pick(req *request.Request, tried map[*backend]bool) *backend {
+	now := p.now()
+	usable := func(b *backend) bool {
+		return !tried[b] && b.available(now)
+	}
+
+	switch p.opts.Strategy {
+	case ConsistentHash:
+		return p.pickHash(p.hashKey(req), usable)
+	case LeastConnections:
+		var best *backend
+		start := int(p.next.Add(1))
+		for i := range p.backends {
+			b := p.backends[(start+i)%len(p.backends)]
+			if usable(b) && (best == nil || b.active.Load() < best.active.Load()) {
+				best = b
+			}
+		}
+		return best
+	default:
+		start := int(p.next.Add(1) - 1)
+		for i := range p.backends {
+			if b := p.backends[(start+i)%len(p.backends)]; usable(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+func (p *Pool) hashKey(req *request.Request) string {
+	if p.opts.HashHeader != "" {
+		if key, ok := req.Headers.Get(p.opts.HashHeader); ok && key != "" {
+			return key
+		}
+	}
+	if p.opts.HashCookie != "" {
+		if c, err := req.Cookie(p.opts.HashCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// pickHash walks the ring from the key's position to the first usable
+// backend, so only keys of an unavailable backend move elsewhere.
+func (p *Pool) pickHash(key string, usable func(*backend) bool) *backend {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+
+	for i := range p.ring {
+		if b := p.ring[(start+i)%len(p.ring)].backend; usable(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// report feeds the outcome of a request into passive outlier ejection.
+func (p *Pool) report(b *backend, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.fails = 0
+		return
+	}
+
+	b.fails++
+	if b.fails >= p.opts.MaxFails {
+		b.fails = 0
+		b.ejectedUntil = p.now().Add(p.opts.EjectFor)
+	}
+}
+
+func (p *Pool) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.probe(ctx, b)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) probe(ctx context.Context, b *backend) {
+	u := *b.url
+	u.Path = singleSlash(u.Path, p.opts.HealthPath)
+	u.RawPath = ""
+
+	healthy := false
+	req, err := client.NewRequest(request.MethodGet, u.String(), nil)
+	if err == nil {
+		resp, err := p.health.Do(req.WithContext(ctx))
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+		}
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.healthy = healthy
+	b.mu.Unlock()
+}
+
+func singleSlash(base, path string) string {
+	for len(base) > 0 && base[len(base)-1] == '/' {
+		base = base[:len(base)-1]
+	}
+	if len(path) == 0 || path[0] != '/' {
+		path = "/" + path
+	}
+	return base + path
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+	"go.serve/internal/server"
+)
+
+// named is a backend answering with its name, or 503 once broken. Its
+// health endpoint follows healthy.
+type named struct {
+	url     string
+	healthy atomic.Bool
+	broken  atomic.Bool
+	hits    atomic.Int64
+}
+
+func startNamed(t *testing.T, name string) *named {
+	n := &named{}
+	n.healthy.Store(true)
+
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		status := response.StatusOK
+		switch {
+		case req.Path() == "/health":
+			if !n.healthy.Load() {
+				status = response.StatusInternalServerError
+			}
+			reply(w, status)
+			return
+		case n.broken.Load():
+			status = response.StatusServiceUnavailable
+		}
+
+		n.hits.Add(1)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		w.WriteBody([]byte(name))
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	n.url = fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	return n
+}
+
+func startPool(t *testing.T, opts PoolOptions) (*Pool, net.Addr) {
+	pool, err := NewPool(opts)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	return pool, startProxy(t, ReverseOptions{Pool: pool})
+}
+
+func get(t *testing.T, addr net.Addr, method, extra string) (int, string) {
+	resp := send(t, addr, method, method+" / HTTP/1.1\r\nHost: x\r\n"+extra+"\r\n")
+	return int(resp.StatusLine.StatusCode), readAll(t, resp)
+}
+
+func parseRequest(t *testing.T, raw string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := startNamed(t, "a"), startNamed(t, "b"), startNamed(t, "c")
+	_, addr := startPool(t, PoolOptions{Upstreams: []string{a.url, b.url, c.url}})
+
+	// Test: Requests take turns
+	var got []string
+	for i := 0; i < 6; i++ {
+		_, body := get(t, addr, "GET", "")
+		got = append(got, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+}
+
+func TestLeastConnections(t *testing.T) {
+	pool, err := NewPool(PoolOptions{
+		Upstreams: []string{"http://a.test", "http://b.test", "http://c.test"},
+		Strategy:  LeastConnections,
+	})
+	require.NoError(t, err)
+	defer pool.Close()
+
+	req := parseRequest(t, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	pool.backends[0].active.Store(3)
+	pool.backends[1].active.Store(1)
+	pool.backends[2].active.Store(2)
+
+	// Test: The least busy backend is chosen
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "b.test", pool.pick(req, nil).url.Host)
+	}
+
+	// Test: Ties are shared
+	pool.backends[0].active.Store(1)
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[pool.pick(req, nil).url.Host] = true
+	}
+	assert.Equal(t, map[string]bool{"a.test": true, "b.test": true}, seen)
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool, err := NewPool(PoolOptions{
+		Upstreams:  []string{"http://a.test", "http://b.test", "http://c.test"},
+		Strategy:   ConsistentHash,
+		HashHeader: "X-User",
+		HashCookie: "sid",
+	})
+	require.NoError(t, err)
+	defer pool.Close()
+
+	pick := func(extra string) string {
+		return pool.pick(parseRequest(t, "GET / HTTP/1.1\r\nHost: x\r\n"+extra+"\r\n"), nil).url.Host
+	}
+
+	// Test: The same key always lands on the same backend, and keys are
+	// spread
+	owners := map[string]string{}
+	spread := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owners[key] = pick("X-User: " + key + "\r\n")
+		assert.Equal(t, owners[key], pick("X-User: "+key+"\r\n"))
+		spread[owners[key]] = true
+	}
+	assert.Len(t, spread, 3)
+
+	// Test: Cookie and client IP keys
+	assert.Equal(t, pick("Cookie: sid=abc\r\n"), pick("Cookie: other=1; sid=abc\r\n"))
+	assert.Equal(t, pick(""), pick(""))
+
+	// Test: Ejecting a backend only moves its own keys
+	ejected := pool.backends[1]
+	ejected.ejectedUntil = time.Now().Add(time.Hour)
+	for key, owner := range owners {
+		now := pick("X-User: " + key + "\r\n")
+		if owner == ejected.url.Host {
+			assert.NotEqual(t, owner, now)
+		} else {
+			assert.Equal(t, owner, now)
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	a, b := startNamed(t, "a"), startNamed(t, "b")
+	_, addr := startPool(t, PoolOptions{
+		Upstreams:      []string{a.url, b.url},
+		HealthPath:     "/health",
+		HealthInterval: 10 * time.Millisecond,
+	})
+
+	// Test: An unhealthy backend gets no traffic
+	b.healthy.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		_, body := get(t, addr, "GET", "")
+		assert.Equal(t, "a", body)
+	}
+
+	// Test: It is used again once it recovers
+	b.healthy.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		_, body := get(t, addr, "GET", "")
+		seen[body] = true
+	}
+	assert.True(t, seen["b"])
+
+	// Test: Nothing healthy
+	a.healthy.Store(false)
+	b.healthy.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	status, _ := get(t, addr, "GET", "")
+	assert.Equal(t, 503, status)
+}
+
+func TestRetryAndEjection(t *testing.T) {
+	a, b := startNamed(t, "a"), startNamed(t, "b")
+	a.broken.Store(true)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := "http://" + l.Addr().String()
+	l.Close()
+
+	pool, addr := startPool(t, PoolOptions{
+		Upstreams: []string{a.url, dead, b.url},
+		MaxFails:  2,
+		Retries:   2,
+	})
+
+	// Test: Idempotent requests move past the 503 and the dead backend
+	status, body := get(t, addr, "GET", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "b", body)
+
+	// Test: Requests with a body are not retried
+	resp := send(t, addr, "PUT", "PUT / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\n\r\nx")
+	readAll(t, resp)
+	assert.Equal(t, response.StatusServiceUnavailable, resp.StatusLine.StatusCode)
+
+	// Test: POST is not idempotent, the dead backend's error is final
+	status, _ = get(t, addr, "POST", "")
+	assert.Equal(t, 502, status)
+
+	// Test: Repeated failures eject both, leaving only b
+	assert.False(t, pool.backends[0].available(time.Now()))
+	assert.False(t, pool.backends[1].available(time.Now()))
+	hits := b.hits.Load()
+	for i := 0; i < 3; i++ {
+		_, body := get(t, addr, "POST", "")
+		assert.Equal(t, "b", body)
+	}
+	assert.Equal(t, hits+3, b.hits.Load())
+
+	// Test: Ejection ends
+	pool.now = func() time.Time { return time.Now().Add(time.Minute) }
+	assert.True(t, pool.backends[1].available(pool.now()))
+}
@@ -0,0 +1,448 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.serve/internal/client"
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+const defaultProxyName = "go.serve"
+
+var ERROR_INVALID_UPSTREAM = fmt.Errorf("Invalid upstream URL")
+
+// Fields that only concern a single connection and are never forwarded
+// (RFC 9110 section 7.6.1), along with any the Connection field names
+var hopByHop = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+type ReverseOptions struct {
+	// Upstream is the base URL requests are forwarded to, e.g.
+	// "http://127.0.0.1:9000/api". Its path is put in front of the
+	// request's.
+	Upstream string
+	// StripPrefix is removed from the request path before forwarding
+	StripPrefix string
+	// PreserveHost sends the client's Host upstream instead of the
+	// upstream's own
+	PreserveHost bool
+	// Name identifies the proxy in Via, defaults to "go.serve"
+	Name string
+	// Proto is the scheme clients used to reach the proxy, passed on in
+	// X-Forwarded-Proto and Forwarded. The server itself only speaks
+	// plain HTTP, the default; set it to "https" when TLS is terminated
+	// in front of it.
+	Proto string
+	// Client makes the upstream requests
+	Client *client.Client
+	// Pool balances requests over several upstreams, replacing Upstream
+	Pool *Pool
+}
+
+// ReverseProxy forwards requests to an upstream server and streams its
+// responses back.
+type ReverseProxy struct {
+	opts     ReverseOptions
+	upstream *url.URL
+	client   *client.Client
+}
+
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", ERROR_INVALID_UPSTREAM, upstream)
+	}
+	return u, nil
+}
+
+func NewReverseProxy(opts ReverseOptions) (*ReverseProxy, error) {
+	var upstream *url.URL
+	if opts.Pool == nil {
+		var err error
+		if upstream, err = parseUpstream(opts.Upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Name == "" {
+		opts.Name = defaultProxyName
+	}
+	if opts.Proto == "" {
+		opts.Proto = "http"
+	}
+
+	c := opts.Client
+	if c == nil {
+		c = client.NewClient(client.Options{MaxIdlePerHost: 32})
+	}
+
+	return &ReverseProxy{
+		opts:     opts,
+		upstream: upstream,
+		client:   c,
+	}, nil
+}
+
+// connectionFields lists the fields that must not be forwarded, the
+// standard hop-by-hop ones and those named in Connection.
+func connectionFields(connection []string) map[string]bool {
+	skip := map[string]bool{}
+	for _, name := range hopByHop {
+		skip[name] = true
+	}
+	for _, value := range connection {
+		for _, name := range strings.Split(value, ",") {
+			skip[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	return skip
+}
+
+func quoteIfNeeded(s string) string {
+	if headers.IsToken([]byte(s)) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// targetURL joins the upstream URL with the request path.
+func (p *ReverseProxy) targetURL(req *request.Request, upstream *url.URL) *url.URL {
+	u := *upstream
+
+	path := req.RawPath()
+	if req.Target.Form == request.FormAsterisk || req.Target.Form == request.FormAuthority {
+		path = ""
+	}
+	if p.opts.StripPrefix != "" && strings.HasPrefix(path, p.opts.StripPrefix) {
+		path = strings.TrimPrefix(path, p.opts.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+
+	rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + path
+	if rawPath == "" {
+		rawPath = "/"
+	}
+	u.Path, _ = url.PathUnescape(rawPath)
+	u.RawPath = rawPath
+	u.RawQuery = req.Target.RawQuery
+
+	return &u
+}
+
+// outgoing builds the request to upstream.
+func (p *ReverseProxy) outgoing(req *request.Request, upstream *url.URL) (*client.Request, error) {
+	out, err := client.NewRequest(req.RequestLine.Method, p.targetURL(req, upstream).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	out = out.WithContext(req.Context())
+
+	if req.HasBody() {
+		out.Body = req.BodyReader()
+		out.ContentLength = req.ContentLength()
+	}
+
+	skip := connectionFields(req.Headers.Values("connection"))
+	for name := range req.Headers.GetAll() {
+		if skip[name] || name == "host" {
+			continue
+		}
+		for _, value := range req.Headers.Values(name) {
+			out.Headers.Set(name, value)
+		}
+	}
+
+	// Trailers are only filled in once the body has been read, which is
+	// when the client sends them on
+	if out.ContentLength < 0 {
+		for _, value := range req.Headers.Values("trailer") {
+			out.Headers.Set("Trailer", value)
+		}
+		out.Trailers = &req.Trailers
+	}
+
+	host, _ := req.Headers.Get("host")
+	if p.opts.PreserveHost {
+		out.Headers.Set("Host", host)
+	}
+
+	p.addForwarded(out.Headers, req, host)
+	return out, nil
+}
+
+// addForwarded tells the upstream who the request came from, both in the
+// de facto X-Forwarded-* fields and the standard Forwarded (RFC 7239).
+func (p *ReverseProxy) addForwarded(out *headers.Headers, req *request.Request, host string) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	if clientIP != "" {
+		forwardedFor := clientIP
+		if prior := out.Values("X-Forwarded-For"); len(prior) > 0 {
+			forwardedFor = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		out.Replace("X-Forwarded-For", forwardedFor)
+	}
+	if host != "" {
+		out.Replace("X-Forwarded-Host", host)
+	}
+	out.Replace("X-Forwarded-Proto", p.opts.Proto)
+
+	node := clientIP
+	if strings.Contains(node, ":") {
+		node = "[" + node + "]"
+	}
+	element := []string{}
+	if node != "" {
+		element = append(element, "for="+quoteIfNeeded(node))
+	}
+	if host != "" {
+		element = append(element, "host="+quoteIfNeeded(host))
+	}
+	element = append(element, "proto="+quoteIfNeeded(p.opts.Proto))
+	out.Set("Forwarded", strings.Join(element, ";"))
+
+	major, minor, _ := req.RequestLine.Version()
+	out.Set("Via", fmt.Sprintf("%d.%d %s", major, minor, p.opts.Name))
+}
+
+// bodiless reports whether a response has no body whatever its headers
+// say (RFC 9112 section 6.3).
+func bodiless(req *request.Request, status int) bool {
+	return req.RequestLine.Method == request.MethodHead ||
+		(status >= 100 && status < 200) ||
+		status == int(response.StatusNoContent) ||
+		status == int(response.StatusNotModified)
+}
+
+func replyRoundTripError(w *response.Writer, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		reply(w, response.StatusGatewayTimeout)
+		return
+	}
+	reply(w, response.StatusBadGateway)
+}
+
+// Serve is a Handler forwarding every request upstream.
+func (p *ReverseProxy) Serve(w *response.Writer, req *request.Request) {
+	if p.opts.Pool != nil {
+		p.serveBalanced(w, req)
+		return
+	}
+
+	out, err := p.outgoing(req, p.upstream)
+	if err != nil {
+		reply(w, response.StatusBadGateway)
+		return
+	}
+
+	resp, err := p.client.RoundTrip(out)
+	if err != nil {
+		replyRoundTripError(w, err)
+		return
+	}
+
+	p.copyResponse(w, req, resp)
+	closeBody(w, resp)
+}
+
+// closeBody sends the answer on before closing the upstream response, as
+// that waits for a request body the upstream didn't wait for to stop
+// being read, which may take the client sending more of it.
+func closeBody(w *response.Writer, resp *client.Response) {
+	w.Flush()
+	resp.Body.Close()
+}
+
+// retryStatus lists the answers that mean another backend may do better
+func retryStatus(status int) bool {
+	switch response.StatusCode(status) {
+	case response.StatusBadGateway, response.StatusServiceUnavailable, response.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// serveBalanced sends the request to a backend chosen by the pool. A
+// request that can safely be sent again, being idempotent and having no
+// body we already consumed, moves on to another backend when one fails.
+func (p *ReverseProxy) serveBalanced(w *response.Writer, req *request.Request) {
+	pool := p.opts.Pool
+
+	attempts := 1
+	if request.IsIdempotent(req.RequestLine.Method) && !req.HasBody() {
+		attempts += pool.opts.Retries
+	}
+
+	tried := map[*backend]bool{}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		b := pool.pick(req, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		out, err := p.outgoing(req, b.url)
+		if err != nil {
+			reply(w, response.StatusBadGateway)
+			return
+		}
+
+		b.active.Add(1)
+		resp, err := p.client.RoundTrip(out)
+		if err != nil {
+			b.active.Add(-1)
+			lastErr = err
+			if req.Context().Err() != nil {
+				return
+			}
+			pool.report(b, true)
+			continue
+		}
+
+		pool.report(b, resp.StatusCode >= 500)
+		if retryStatus(resp.StatusCode) && attempt+1 < attempts {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			b.active.Add(-1)
+			continue
+		}
+
+		p.copyResponse(w, req, resp)
+		closeBody(w, resp)
+		b.active.Add(-1)
+		return
+	}
+
+	if lastErr != nil {
+		replyRoundTripError(w, lastErr)
+		return
+	}
+	reply(w, response.StatusServiceUnavailable)
+}
+
+// copyResponse streams the upstream response to the client. The body is
+// sent with the upstream's length when it is known, and chunked otherwise
+// or when trailers follow.
+func (p *ReverseProxy) copyResponse(w *response.Writer, req *request.Request, resp *client.Response) {
+	h := headers.NewHeaders()
+	skip := connectionFields(resp.Headers.Values("connection"))
+	for name := range resp.Headers.GetAll() {
+		if skip[name] {
+			continue
+		}
+		for _, value := range resp.Headers.Values(name) {
+			h.Set(name, value)
+		}
+	}
+	h.Set("Via", fmt.Sprintf("%s %s", resp.HttpVersion, p.opts.Name))
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return
+	}
+
+	if bodiless(req, resp.StatusCode) {
+		w.WriteHeaders(*h)
+		return
+	}
+
+	trailers := allowedTrailers(resp.Headers)
+	if resp.ContentLength >= 0 && len(trailers) == 0 {
+		h.Replace("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		if err := w.WriteHeaders(*h); err != nil {
+			return
+		}
+		copyBody(resp.Body, w.WriteBody, w.Flush)
+		return
+	}
+
+	h.Delete("Content-Length")
+	h.Replace("Transfer-Encoding", "chunked")
+	for _, name := range trailers {
+		h.Set("Trailer", name)
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return
+	}
+
+	// A body cut short must not look complete, so the chunked framing is
+	// only finished when the upstream finished
+	if err := copyBody(resp.Body, w.WriteChunkedBody, w.Flush); err != nil {
+		return
+	}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return
+	}
+
+	// Only what was announced can follow, anything else is dropped
+	tr := headers.NewHeaders()
+	for _, name := range trailers {
+		for _, value := range resp.Trailers.Values(name) {
+			tr.Set(name, value)
+		}
+	}
+	if len(tr.GetAll()) > 0 {
+		w.WriteTrailers(*tr)
+	}
+}
+
+// allowedTrailers lists the trailer fields h announces that may be passed
+// on.
+func allowedTrailers(h headers.Headers) []string {
+	var names []string
+	for _, value := range h.Values("trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" && response.TrailerAllowed(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// copyBody writes src to the client as it arrives, flushing each read so
+// streamed responses are not held back in the buffer.
+func copyBody(src io.Reader, write func([]byte) (int, error), flush func() error) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
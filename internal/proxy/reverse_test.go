@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+	"go.serve/internal/server"
+)
+
+// upstream describes every request it gets, and streams a chunked
+// response with a trailer for /stream.
+func upstream(t *testing.T) string {
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/api/stream" {
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Checksum")
+			h.Set("Connection", "X-Upstream-Secret")
+			h.Set("X-Upstream-Secret", "1")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("part one, "))
+			w.WriteChunkedBody([]byte("part two"))
+			w.WriteChunkedBodyDone()
+			tr := headers.NewHeaders()
+			tr.Set("X-Checksum", "abc")
+			w.WriteTrailers(*tr)
+			return
+		}
+
+		// Answers before reading a body that may still be on its way
+		if req.Path() == "/api/early" {
+			reply(w, response.StatusContentTooLarge)
+			return
+		}
+
+		body, err := req.ReadBody()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		var lines []string
+		for name, value := range req.Headers.GetAll() {
+			lines = append(lines, name+": "+value)
+		}
+		for name, value := range req.Trailers.GetAll() {
+			lines = append(lines, "trailer "+name+": "+value)
+		}
+		sort.Strings(lines)
+
+		out := fmt.Sprintf("%s %s?%s\n%s\nbody: %s", req.RequestLine.Method, req.RawPath(), req.Target.RawQuery, strings.Join(lines, "\n"), body)
+		status := response.StatusOK
+		if req.Path() == "/api/missing" {
+			status = response.StatusNotFound
+		}
+
+		h := response.GetDefaultHeaders(len(out))
+		h.Set("X-Upstream", "yes")
+		w.WriteStatusLine(status)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(out))
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return "http://" + s.Addr().String() + "/api"
+}
+
+func startProxy(t *testing.T, opts ReverseOptions) net.Addr {
+	p, err := NewReverseProxy(opts)
+	require.NoError(t, err)
+
+	s, err := server.Serve(0, p.Serve)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s.Addr()
+}
+
+func send(t *testing.T, addr net.Addr, method, raw string) *response.Response {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+
+	resp, err := response.ReadResponse(bufio.NewReader(conn), method)
+	require.NoError(t, err)
+	return resp
+}
+
+func readAll(t *testing.T, resp *response.Response) string {
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestReverseProxy(t *testing.T) {
+	addr := startProxy(t, ReverseOptions{Upstream: upstream(t), StripPrefix: "/app"})
+
+	// Test: Method, path, query, headers and body are forwarded
+	resp := send(t, addr, "POST", "POST /app/items%2F1?x=1&y=2 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Content-Length: 5\r\n"+
+		"Connection: keep-alive, X-Secret\r\n"+
+		"X-Secret: hop\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"X-Forwarded-For: 10.0.0.1\r\n"+
+		"X-Custom: kept\r\n\r\nhello")
+	body := readAll(t, resp)
+
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	upstreamField, _ := resp.Headers.Get("x-upstream")
+	assert.Equal(t, "yes", upstreamField)
+	via, _ := resp.Headers.Get("via")
+	assert.Equal(t, "1.1 go.serve", via)
+	assert.True(t, strings.HasPrefix(body, "POST /api/items%2F1?x=1&y=2\n"), body)
+	assert.Contains(t, body, "x-custom: kept\n")
+	assert.Contains(t, body, "x-forwarded-for: 10.0.0.1, 127.0.0.1\n")
+	assert.Contains(t, body, "x-forwarded-host: example.com\n")
+	assert.Contains(t, body, "x-forwarded-proto: http\n")
+	assert.Contains(t, body, "forwarded: for=127.0.0.1;host=example.com;proto=http\n")
+	assert.Contains(t, body, "via: 1.1 go.serve\n")
+	assert.True(t, strings.HasSuffix(body, "body: hello"), body)
+	assert.NotContains(t, body, "x-secret")
+	assert.NotContains(t, body, "keep-alive")
+	assert.NotContains(t, body, "user-agent")
+
+	// Test: Upstream status is passed on
+	resp = send(t, addr, "GET", "GET /app/missing HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	readAll(t, resp)
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+
+	// Test: HEAD keeps the upstream's length but has no body
+	resp = send(t, addr, "HEAD", "HEAD /app/x HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	length, _ := resp.Headers.Get("content-length")
+	assert.NotEqual(t, "0", length)
+	assert.Equal(t, "", readAll(t, resp))
+
+	// Test: Chunked upload with a trailer
+	resp = send(t, addr, "PUT", "PUT /app/upload HTTP/1.1\r\nHost: example.com\r\n"+
+		"Transfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n"+
+		"3\r\nabc\r\n3\r\ndef\r\n0\r\nX-Sum: 42\r\n\r\n")
+	body = readAll(t, resp)
+	assert.True(t, strings.HasSuffix(body, "body: abcdef"), body)
+	assert.Contains(t, body, "trailer x-sum: 42\n")
+
+	// Test: The scheme clients used is configurable
+	addr = startProxy(t, ReverseOptions{Upstream: upstream(t), Proto: "https"})
+	resp = send(t, addr, "GET", "GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	body = readAll(t, resp)
+	assert.Contains(t, body, "x-forwarded-proto: https\n")
+	assert.Contains(t, body, "forwarded: for=127.0.0.1;host=example.com;proto=https\n")
+}
+
+func TestReverseProxyStreaming(t *testing.T) {
+	addr := startProxy(t, ReverseOptions{Upstream: upstream(t)})
+
+	// Test: Chunked body and trailers are streamed back, hop-by-hop
+	// fields are not
+	resp := send(t, addr, "GET", "GET /stream HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "part one, part two", readAll(t, resp))
+	te, _ := resp.Headers.Get("transfer-encoding")
+	assert.Equal(t, "chunked", te)
+	checksum, _ := resp.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+	_, ok := resp.Headers.Get("x-upstream-secret")
+	assert.False(t, ok)
+
+	// Test: HTTP/1.0 clients get the body without chunked framing
+	resp = send(t, addr, "GET", "GET /stream HTTP/1.0\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "part one, part two", readAll(t, resp))
+	_, ok = resp.Headers.Get("transfer-encoding")
+	assert.False(t, ok)
+}
+
+func TestReverseProxyEarlyAnswer(t *testing.T) {
+	addr := startProxy(t, ReverseOptions{Upstream: upstream(t)})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: The upstream answers while the body is still being sent. The
+	// client only sends the rest once it has the answer.
+	size := 1 << 20
+	chunk := []byte(strings.Repeat("x", 16<<10))
+	_, err = conn.Write([]byte(fmt.Sprintf("POST /early HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n", size)))
+	require.NoError(t, err)
+	_, err = conn.Write(chunk)
+	require.NoError(t, err)
+
+	resp, err := response.ReadResponse(bufio.NewReader(conn), "POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusContentTooLarge, resp.StatusLine.StatusCode)
+
+	for n := len(chunk); n < size; n += len(chunk) {
+		if _, err := conn.Write(chunk); err != nil {
+			break
+		}
+	}
+
+	// Test: The proxy is fine afterwards
+	resp = send(t, addr, "GET", "GET /after HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.True(t, strings.HasPrefix(readAll(t, resp), "GET /api/after?"))
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	_, err := NewReverseProxy(ReverseOptions{Upstream: "ftp://example.com"})
+	assert.ErrorIs(t, err, ERROR_INVALID_UPSTREAM)
+
+	// Test: Unreachable upstream
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+
+	addr := startProxy(t, ReverseOptions{Upstream: "http://" + closed})
+	resp := send(t, addr, "GET", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var ERROR_INVALID_RULE = fmt.Errorf("Invalid destination rule")
+var ERROR_DESTINATION_NOT_ALLOWED = fmt.Errorf("Destination not allowed")
+
+// rule matches destinations by host and port. Rules are written as
+// "host", "host:port" or "host:low-high", where host is "*", a name, a
+// "*.example.com" wildcard, an IP address or a CIDR prefix, and port may
+// be "*". IPv6 hosts with a port are bracketed.
+type rule struct {
+	// name is an exact host name, or a suffix starting with "." for
+	// wildcards. Empty with an invalid prefix matches any host.
+	name   string
+	prefix netip.Prefix
+	portLo int
+	portHi int
+}
+
+func parseRule(s string) (rule, error) {
+	r := rule{portLo: 0, portHi: 65535}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port, unless it was a malformed one
+		host, port = strings.Trim(s, "[]"), "*"
+	}
+
+	if port != "*" {
+		lo, hi, isRange := strings.Cut(port, "-")
+		if !isRange {
+			hi = lo
+		}
+		if r.portLo, err = strconv.Atoi(lo); err != nil {
+			return r, ERROR_INVALID_RULE
+		}
+		if r.portHi, err = strconv.Atoi(hi); err != nil {
+			return r, ERROR_INVALID_RULE
+		}
+		if r.portLo < 0 || r.portHi > 65535 || r.portLo > r.portHi {
+			return r, ERROR_INVALID_RULE
+		}
+	}
+
+	switch {
+	case host == "":
+		return r, ERROR_INVALID_RULE
+	case host == "*":
+	case strings.Contains(host, "/"):
+		if r.prefix, err = netip.ParsePrefix(host); err != nil {
+			return r, ERROR_INVALID_RULE
+		}
+		r.prefix = r.prefix.Masked()
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			r.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		} else if strings.HasPrefix(host, "*.") {
+			r.name = strings.ToLower(host[1:])
+		} else {
+			r.name = strings.ToLower(host)
+		}
+	}
+
+	return r, nil
+}
+
+func parseRules(list []string) ([]rule, error) {
+	rules := make([]rule, 0, len(list))
+	for _, s := range list {
+		r, err := parseRule(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", err, s)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (r rule) matchesPort(port int) bool {
+	return port >= r.portLo && port <= r.portHi
+}
+
+// any reports whether the rule matches every host.
+func (r rule) any() bool {
+	return r.name == "" && !r.prefix.IsValid()
+}
+
+// matchName checks a rule against the host name the client asked for.
+func (r rule) matchName(host string, port int) bool {
+	if !r.matchesPort(port) {
+		return false
+	}
+	if r.any() {
+		return true
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return r.prefix.IsValid() && r.prefix.Contains(addr.Unmap())
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(r.name, ".") {
+		return strings.HasSuffix(host, r.name)
+	}
+	return r.name != "" && host == r.name
+}
+
+// matchAddr checks an address rule against where the name resolved to.
+func (r rule) matchAddr(addr netip.Addr, port int) bool {
+	return r.prefix.IsValid() && r.matchesPort(port) && r.prefix.Contains(addr.Unmap())
+}
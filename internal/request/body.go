@@ -0,0 +1,251 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go.serve/internal/chunked"
+	"go.serve/internal/headers"
+)
+
+var ERROR_INVALID_CONTENT_LENGTH = fmt.Errorf("Invalid Content-Length")
+var ERROR_CONFLICTING_FRAMING = fmt.Errorf("Both Content-Length and Transfer-Encoding sent")
+var ERROR_UNSUPPORTED_TRANSFER_ENCODING = fmt.Errorf("Unsupported Transfer-Encoding")
+var ERROR_TRANSFER_ENCODING_HTTP10 = fmt.Errorf("Transfer-Encoding is not allowed in HTTP/1.0")
+
+// parseFraming decides how the body is delimited (RFC 9112 section 6.3).
+// Anything ambiguous is an error rather than a guess, since a guess that
+// differs from a proxy in front of us allows request smuggling.
+func (r *Request) parseFraming() error {
+	r.contentLength = 0
+
+	te := r.Headers.Values("transfer-encoding")
+	_, hasLength := r.Headers.Get("content-length")
+
+	if len(te) > 0 {
+		// HTTP/1.0 has no chunked coding, so the framing is faulty
+		// (RFC 9112 section 6.1)
+		if r.RequestLine.IsHTTP10() {
+			return ERROR_TRANSFER_ENCODING_HTTP10
+		}
+
+		if hasLength {
+			return ERROR_CONFLICTING_FRAMING
+		}
+
+		// chunked is the only coding we support and it must come last
+		codings := strings.Split(strings.Join(te, ","), ",")
+		for i, coding := range codings {
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "chunked") || i != len(codings)-1 {
+				return ERROR_UNSUPPORTED_TRANSFER_ENCODING
+			}
+		}
+
+		r.chunked = true
+		r.contentLength = -1
+		return nil
+	}
+
+	if !hasLength {
+		return nil
+	}
+
+	// A list of identical values is allowed, e.g. "42, 42"
+	length := int64(-1)
+	for _, value := range r.Headers.Values("content-length") {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+				return ERROR_INVALID_CONTENT_LENGTH
+			}
+
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || length != -1 && n != length {
+				return ERROR_INVALID_CONTENT_LENGTH
+			}
+			length = n
+		}
+	}
+
+	r.contentLength = length
+	return nil
+}
+
+// lengthReader reads exactly remaining bytes from src
+type lengthReader struct {
+	src       *bufio.Reader
+	remaining int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+
+	n, err := l.src.Read(p)
+	l.remaining -= int64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// body streams the request body out of the connection buffer.
+type body struct {
+	req *Request
+	src io.Reader
+
+	// onFirstRead runs before the first byte is read, e.g. to send
+	// 100 Continue
+	onFirstRead func() error
+	started     bool
+	err         error
+
+	// set by ReadBody so every copy of the request sees the same bytes
+	all []byte
+}
+
+func newBody(req *Request, src *bufio.Reader) *body {
+	b := &body{req: req}
+
+	switch {
+	case req.chunked:
+		// Set up now so copies of the request share the trailers
+		req.Trailers = *headers.NewHeaders()
+		b.src = chunked.NewReader(src, &req.Trailers)
+	default:
+		b.src = &lengthReader{
+			src:       src,
+			remaining: max(req.contentLength, 0),
+		}
+	}
+
+	// Bodies the client sent a digest for are verified as they are read
+	checks, err := parseDigests(req.Headers)
+	if err != nil || len(checks) > 0 {
+		b.src = &digestReader{src: b.src, checks: checks, err: err}
+	}
+
+	return b
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	// State is already StateDone, and must not be written again since
+	// the connection may be reading the next request concurrently
+	if !b.req.HasBody() {
+		return 0, io.EOF
+	}
+
+	if !b.started {
+		b.started = true
+		if b.onFirstRead != nil {
+			if err := b.onFirstRead(); err != nil {
+				b.err = err
+				return 0, err
+			}
+		}
+	}
+
+	n, err := b.src.Read(p)
+	var digestErr *DigestError
+	if err == io.EOF || errors.As(err, &digestErr) {
+		// A failed digest check still leaves the body fully read
+		b.err = err
+		b.req.State = StateDone
+	} else if err != nil {
+		b.err = err
+		b.req.State = StateError
+	}
+
+	return n, err
+}
+
+// BodyError returns the error reading the body failed with, e.g. a
+// *DigestError, or nil if it has not failed.
+func (r *Request) BodyError() error {
+	if r.body == nil || r.body.err == io.EOF {
+		return nil
+	}
+	return r.body.err
+}
+
+// ContentLength is the declared body length: 0 if there is no body and
+// -1 if the body is chunked.
+func (r *Request) ContentLength() int64 {
+	return r.contentLength
+}
+
+// BodyReader returns the request body as a stream. Once ReadBody has been
+// called it reads from the buffered copy instead.
+func (r *Request) BodyReader() io.Reader {
+	if r.body == nil {
+		return bytes.NewReader(nil)
+	}
+
+	if r.body.all != nil {
+		return bytes.NewReader(r.body.all)
+	}
+
+	return r.body
+}
+
+// ReadBody reads the rest of the body into Body and returns it. The body
+// is kept, so later calls return the same bytes; nil means there is no
+// body. RequestFromReader has already read it.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.body == nil {
+		return r.Body, nil
+	}
+
+	if r.body.all == nil {
+		all, err := io.ReadAll(r.body)
+		if err != nil {
+			return nil, err
+		}
+		r.body.all = all
+	}
+
+	r.Body = r.body.all
+	return r.Body, nil
+}
+
+// OnBodyRead registers fn to run right before the first body byte is read.
+// If fn fails the body read fails with the same error.
+func (r *Request) OnBodyRead(fn func() error) {
+	if r.body != nil {
+		r.body.onFirstRead = fn
+	}
+}
+
+// ExpectsContinue reports whether the client is waiting for a 100 Continue
+// before it sends the body. HTTP/1.0 clients can't receive 1xx responses,
+// so their Expect field is ignored (RFC 9110 section 10.1.1).
+func (r *Request) ExpectsContinue() bool {
+	if r.RequestLine.IsHTTP10() {
+		return false
+	}
+
+	expect, ok := r.Headers.Get("expect")
+	return ok && strings.EqualFold(expect, "100-continue")
+}
+
+// AwaitingContinue reports whether the client is still holding back the
+// body because nobody has started reading it.
+func (r *Request) AwaitingContinue() bool {
+	return r.ExpectsContinue() && r.HasBody() && r.body != nil && !r.body.started
+}
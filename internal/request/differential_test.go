@@ -0,0 +1,190 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// framing is what two parsers in a chain have to agree on: where a request
+// ends and what it asks for. If a proxy and the server behind it disagree
+// on any of it, one request can be smuggled inside another.
+type framing struct {
+	method string
+	target string
+	body   string
+	// what is left for the next request on the connection
+	rest string
+}
+
+func (f *framing) String() string {
+	return fmt.Sprintf("%s %s body=%q rest=%q", f.method, f.target, f.body, f.rest)
+}
+
+func parseOurs(data []byte) (*framing, error) {
+	src := bytes.NewReader(data)
+	reader := NewReader(src)
+	defer reader.Release()
+
+	r, err := reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+
+	rest, _ := io.ReadAll(src)
+	return &framing{
+		method: r.RequestLine.Method,
+		target: r.RequestLine.RequestTarget,
+		body:   string(body),
+		rest:   string(reader.Buffered()) + string(rest),
+	}, nil
+}
+
+func parseNetHTTP(data []byte) (*framing, error) {
+	src := bytes.NewReader(data)
+	br := bufio.NewReader(src)
+
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+
+	buffered, _ := br.Peek(br.Buffered())
+	rest, _ := io.ReadAll(src)
+	return &framing{
+		method: r.Method,
+		target: r.RequestURI,
+		body:   string(body),
+		rest:   string(buffered) + string(rest),
+	}, nil
+}
+
+// disagreement explains how our reading of data differs from net/http's
+// in a way that matters for smuggling, or returns "" if it doesn't.
+// Rejecting what net/http accepts is fine, being stricter is not a risk.
+// Accepting what it rejects is only flagged when it got through the head
+// and failed on the body, as that means we framed the body differently.
+func disagreement(data []byte) string {
+	ours, ourErr := parseOurs(data)
+	if ourErr != nil {
+		return ""
+	}
+
+	theirs, theirErr := parseNetHTTP(data)
+	if theirErr != nil {
+		if strings.HasPrefix(theirErr.Error(), "body: ") {
+			return fmt.Sprintf("we read %v, net/http failed with %v", ours, theirErr)
+		}
+		return ""
+	}
+
+	if *ours != *theirs {
+		return fmt.Sprintf("we read %v, net/http read %v", ours, theirs)
+	}
+	return ""
+}
+
+// Real requests and known smuggling attempts, shared by the fuzz targets
+var seedRequests = []string{
+	"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	"GET /index.html?q=1 HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0\r\nAccept: */*\r\nAccept-Encoding: gzip, deflate\r\nConnection: keep-alive\r\n\r\n",
+	"GET / HTTP/1.0\r\n\r\n",
+	"HEAD /video HTTP/1.1\r\nHost: example.com\r\nRange: bytes=0-99\r\n\r\n",
+	"OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+	"GET http://example.com/a?b HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	"POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 7\r\n\r\na=1&b=2",
+	"POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n5;ext=1\r\nhello\r\n0\r\nX-Sum: 42\r\n\r\n",
+	"PUT /a HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\nabcGET /next HTTP/1.1\r\nHost: x\r\n\r\n",
+	"GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+	// CL.TE and TE.CL
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+	// TE.TE obfuscation
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding:\tchunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nX: y\r\n Transfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: CHUNKED\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.0\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n0\r\n\r\n",
+	// Content-Length tricks
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 5\r\n\r\nhello",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\nhello",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0x5\r\n\r\nhello",
+	"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999999999999\r\n\r\n",
+	// Chunk size tricks
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\n0\n\n",
+	"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000005\r\nhello\r\n0\r\n\r\n",
+	// Line ending tricks
+	"GET / HTTP/1.1\nHost: x\n\n",
+	"GET / HTTP/1.1\r\nHost: x\rX: y\r\n\r\n",
+	"GET /\x00 HTTP/1.1\r\nHost: x\r\n\r\n",
+	"GET  / HTTP/1.1\r\nHost: x\r\n\r\n",
+	"get / HTTP/1.1\r\nHost: x\r\n\r\n",
+	"GET / HTTP/1.1 \r\nHost: x\r\n\r\n",
+	"GET / HTTP/2.0\r\nHost: x\r\n\r\n",
+}
+
+func FuzzDifferential(f *testing.F) {
+	for _, seed := range seedRequests {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if reason := disagreement(data); reason != "" {
+			t.Errorf("%q: %s", data, reason)
+		}
+	})
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	for _, seed := range seedRequests {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := RequestFromReader(bytes.NewReader(data))
+
+		// However the bytes arrive, the outcome is the same
+		slow, slowErr := RequestFromReader(&chunkReader{data: string(data), numBytesPerRead: 1})
+		if (err == nil) != (slowErr == nil) {
+			t.Fatalf("%q: read whole %v, a byte at a time %v", data, err, slowErr)
+		}
+		if err != nil {
+			return
+		}
+
+		if r.State != StateDone {
+			t.Errorf("%q: parsed request in state %d", data, r.State)
+		}
+		body, _ := r.ReadBody()
+		slowBody, _ := slow.ReadBody()
+		if r.RequestLine.Method != slow.RequestLine.Method ||
+			r.RequestLine.RequestTarget != slow.RequestLine.RequestTarget ||
+			!bytes.Equal(body, slowBody) {
+			t.Errorf("%q: read whole and a byte at a time differ", data)
+		}
+		if r.ContentLength() >= 0 && int64(len(body)) != r.ContentLength() {
+			t.Errorf("%q: body of %d bytes for Content-Length %d", data, len(body), r.ContentLength())
+		}
+	})
+}
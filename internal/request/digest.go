@@ -0,0 +1,127 @@
+package request
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"go.serve/internal/headers"
+)
+
+var ERROR_DIGEST_MISMATCH = fmt.Errorf("Body does not match its digest")
+var ERROR_MALFORMED_DIGEST = fmt.Errorf("Malformed digest")
+
+// DigestError is returned by the body once it has been read to the end
+// and it fails the integrity check the client asked for.
+type DigestError struct {
+	// Field is the header carrying the digest, content-digest or
+	// content-md5
+	Field     string
+	Algorithm string
+	// Err is ERROR_DIGEST_MISMATCH or ERROR_MALFORMED_DIGEST
+	Err error
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.Err, e.Field, e.Algorithm)
+}
+
+func (e *DigestError) Unwrap() error {
+	return e.Err
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+type digestCheck struct {
+	field     string
+	algorithm string
+	want      []byte
+	hash      hash.Hash
+}
+
+// parseDigests collects the checks the body has to pass: every supported
+// algorithm of Content-Digest (RFC 9530), e.g. "sha-256=:base64:", and the
+// older Content-MD5 (RFC 1864). Unknown algorithms are ignored.
+func parseDigests(h headers.Headers) ([]*digestCheck, error) {
+	checks := []*digestCheck{}
+
+	for _, value := range h.Values("content-digest") {
+		for _, member := range strings.Split(value, ",") {
+			name, sum, _ := strings.Cut(member, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			newHash := digestAlgorithms[name]
+			if newHash == nil {
+				continue
+			}
+
+			sum = strings.TrimSpace(sum)
+			if len(sum) < 2 || sum[0] != ':' || sum[len(sum)-1] != ':' {
+				return nil, &DigestError{Field: "content-digest", Algorithm: name, Err: ERROR_MALFORMED_DIGEST}
+			}
+			check, err := newDigestCheck("content-digest", name, sum[1:len(sum)-1], newHash)
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, check)
+		}
+	}
+
+	if sum, ok := h.Get("content-md5"); ok {
+		check, err := newDigestCheck("content-md5", "md5", strings.TrimSpace(sum), md5.New)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+func newDigestCheck(field, algorithm, sum string, newHash func() hash.Hash) (*digestCheck, error) {
+	h := newHash()
+	want, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil || len(want) != h.Size() {
+		return nil, &DigestError{Field: field, Algorithm: algorithm, Err: ERROR_MALFORMED_DIGEST}
+	}
+
+	return &digestCheck{field: field, algorithm: algorithm, want: want, hash: h}, nil
+}
+
+// digestReader hashes the body as it is read and checks the sums at the
+// end. A malformed digest field is also only reported there, so the body
+// is still consumed and the connection stays usable.
+type digestReader struct {
+	src    io.Reader
+	checks []*digestCheck
+	err    error
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.src.Read(p)
+	for _, check := range d.checks {
+		check.hash.Write(p[:n])
+	}
+
+	if err != io.EOF {
+		return n, err
+	}
+
+	if d.err != nil {
+		return n, d.err
+	}
+	for _, check := range d.checks {
+		if !bytes.Equal(check.hash.Sum(nil), check.want) {
+			return n, &DigestError{Field: check.field, Algorithm: check.algorithm, Err: ERROR_DIGEST_MISMATCH}
+		}
+	}
+	return n, io.EOF
+}
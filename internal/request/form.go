@@ -0,0 +1,372 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+
+	"go.serve/internal/headers"
+)
+
+// FormLimits bounds how much of a form body is accepted. Zero fields use
+// the value from DefaultFormLimits.
+type FormLimits struct {
+	// MaxFieldSize is the largest non-file value
+	MaxFieldSize int64
+	// MaxPartSize is the largest single file part
+	MaxPartSize int64
+	// MaxTotalSize is the largest form body
+	MaxTotalSize int64
+	// MaxMemory is how many file bytes are kept in memory before parts
+	// are written to temporary files
+	MaxMemory int64
+}
+
+var DefaultFormLimits = FormLimits{
+	MaxFieldSize: 1 << 20,
+	MaxPartSize:  32 << 20,
+	MaxTotalSize: 64 << 20,
+	MaxMemory:    10 << 20,
+}
+
+var ERROR_MALFORMED_FORM = fmt.Errorf("Malformed form body")
+var ERROR_NOT_MULTIPART = fmt.Errorf("Request Content-Type is not multipart/form-data")
+var ERROR_FORM_TOO_LARGE = fmt.Errorf("Form body too large")
+var ERROR_FIELD_TOO_LARGE = fmt.Errorf("Form field too large")
+var ERROR_PART_TOO_LARGE = fmt.Errorf("Form file part too large")
+var ERROR_MISSING_FILE = fmt.Errorf("No such file in form")
+
+func (l FormLimits) withDefaults() FormLimits {
+	if l.MaxFieldSize == 0 {
+		l.MaxFieldSize = DefaultFormLimits.MaxFieldSize
+	}
+	if l.MaxPartSize == 0 {
+		l.MaxPartSize = DefaultFormLimits.MaxPartSize
+	}
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = DefaultFormLimits.MaxTotalSize
+	}
+	if l.MaxMemory == 0 {
+		l.MaxMemory = DefaultFormLimits.MaxMemory
+	}
+
+	return l
+}
+
+type FileHeader struct {
+	Filename string
+	Header   headers.Headers
+	Size     int64
+
+	content []byte
+	tmpFile string
+}
+
+// Open returns the file contents, from memory or from the temporary file
+// it was spilled to.
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tmpFile != "" {
+		return os.Open(fh.tmpFile)
+	}
+
+	return io.NopCloser(bytes.NewReader(fh.content)), nil
+}
+
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll deletes any temporary files created for the form.
+func (f *MultipartForm) RemoveAll() error {
+	var err error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tmpFile == "" {
+				continue
+			}
+			if rmErr := os.Remove(fh.tmpFile); rmErr != nil && err == nil {
+				err = rmErr
+			}
+		}
+	}
+
+	return err
+}
+
+func (r *Request) mediaType() (string, map[string]string) {
+	contentType, ok := r.Headers.Get("content-type")
+	if !ok {
+		return "", nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+
+	return mediaType, params
+}
+
+// limitedReader fails with tooLarge instead of stopping quietly at the
+// limit, so truncated bodies are never mistaken for complete ones.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	tooLarge error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Only an error if there is more data waiting
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, l.tooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func mergeValues(dst url.Values, src map[string][]string) {
+	for k, v := range src {
+		dst[k] = append(dst[k], v...)
+	}
+}
+
+// ParseForm fills Form with the query values and, for
+// application/x-www-form-urlencoded bodies, PostForm with the body values.
+// Body values come before query values in Form.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+
+	limits := r.FormLimits.withDefaults()
+
+	postForm := url.Values{}
+	mediaType, _ := r.mediaType()
+	if mediaType == "application/x-www-form-urlencoded" {
+		body, err := io.ReadAll(&limitedReader{
+			r:        r.BodyReader(),
+			n:        limits.MaxTotalSize,
+			tooLarge: ERROR_FORM_TOO_LARGE,
+		})
+		if err != nil {
+			return err
+		}
+
+		values, err := parseQuery(string(body))
+		if err != nil {
+			return ERROR_MALFORMED_FORM
+		}
+
+		for _, vs := range values {
+			for _, v := range vs {
+				if int64(len(v)) > limits.MaxFieldSize {
+					return ERROR_FIELD_TOO_LARGE
+				}
+			}
+		}
+		postForm = values
+	}
+
+	r.PostForm = postForm
+	r.Form = url.Values{}
+	mergeValues(r.Form, r.PostForm)
+	mergeValues(r.Form, r.Query())
+	return nil
+}
+
+// ParseMultipartForm parses a multipart/form-data body into MultipartForm.
+// File parts are kept in memory until FormLimits.MaxMemory is used up and
+// are streamed to temporary files after that.
+func (r *Request) ParseMultipartForm() error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+
+	mediaType, params := r.mediaType()
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return ERROR_NOT_MULTIPART
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	limits := r.FormLimits.withDefaults()
+	body := &limitedReader{
+		r:        r.BodyReader(),
+		n:        limits.MaxTotalSize,
+		tooLarge: ERROR_FORM_TOO_LARGE,
+	}
+
+	form := &MultipartForm{
+		Value: map[string][]string{},
+		File:  map[string][]*FileHeader{},
+	}
+	memory := limits.MaxMemory
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return formError(err)
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(&limitedReader{
+				r:        part,
+				n:        limits.MaxFieldSize,
+				tooLarge: ERROR_FIELD_TOO_LARGE,
+			})
+			if err != nil {
+				form.RemoveAll()
+				return formError(err)
+			}
+
+			form.Value[name] = append(form.Value[name], string(value))
+			continue
+		}
+
+		fh, err := readFilePart(part, limits.MaxPartSize, &memory)
+		if err != nil {
+			form.RemoveAll()
+			return formError(err)
+		}
+		form.File[name] = append(form.File[name], fh)
+	}
+
+	r.MultipartForm = form
+	r.onCleanup(form.RemoveAll)
+	mergeValues(r.PostForm, form.Value)
+	mergeValues(r.Form, form.Value)
+	return nil
+}
+
+// formError keeps limit errors and reports anything the multipart reader
+// trips over as a malformed form.
+func formError(err error) error {
+	for _, limitErr := range []error{ERROR_FORM_TOO_LARGE, ERROR_FIELD_TOO_LARGE, ERROR_PART_TOO_LARGE} {
+		if errors.Is(err, limitErr) {
+			return limitErr
+		}
+	}
+
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+
+	return ERROR_MALFORMED_FORM
+}
+
+func readFilePart(part *multipart.Part, maxSize int64, memory *int64) (*FileHeader, error) {
+	h := headers.NewHeaders()
+	for k, vs := range part.Header {
+		for _, v := range vs {
+			h.Set(k, v)
+		}
+	}
+
+	fh := &FileHeader{
+		Filename: part.FileName(),
+		Header:   *h,
+	}
+
+	src := &limitedReader{
+		r:        part,
+		n:        maxSize,
+		tooLarge: ERROR_PART_TOO_LARGE,
+	}
+
+	// Read one byte past the memory budget to know if the part fits
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, src, *memory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n <= *memory {
+		*memory -= n
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return fh, nil
+	}
+
+	tmp, err := os.CreateTemp("", "goserve-multipart-")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.MultiReader(&buf, src))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	*memory = 0
+	fh.tmpFile = tmp.Name()
+	fh.Size = size
+	return fh, nil
+}
+
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		if r.mediaTypeIs("multipart/form-data") {
+			r.ParseMultipartForm()
+		} else {
+			r.ParseForm()
+		}
+	}
+
+	return r.Form.Get(key)
+}
+
+func (r *Request) PostFormValue(key string) string {
+	r.FormValue(key)
+
+	return r.PostForm.Get(key)
+}
+
+func (r *Request) FormFile(key string) (*FileHeader, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(); err != nil {
+			return nil, err
+		}
+	}
+
+	files := r.MultipartForm.File[key]
+	if len(files) == 0 {
+		return nil, ERROR_MISSING_FILE
+	}
+
+	return files[0], nil
+}
+
+func (r *Request) mediaTypeIs(mediaType string) bool {
+	mt, _ := r.mediaType()
+	return mt == mediaType
+}
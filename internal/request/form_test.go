@@ -0,0 +1,136 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(t *testing.T, target, contentType, body string) *Request {
+	reader := &chunkReader{
+		data: fmt.Sprintf("POST %s HTTP/1.1\r\n"+
+			"Host: localhost:42069\r\n"+
+			"Content-Type: %s\r\n"+
+			"Content-Length: %d\r\n"+
+			"\r\n%s", target, contentType, len(body), body),
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	return r
+}
+
+const multipartBody = "--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"holiday\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"beach.jpg\"\r\n" +
+	"Content-Type: image/jpeg\r\n" +
+	"\r\n" +
+	"0123456789\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"pier.jpg\"\r\n" +
+	"\r\n" +
+	"abcdefghijklmnopqrstuvwxyz\r\n" +
+	"--xyz--\r\n"
+
+func TestParseForm(t *testing.T) {
+	// Test: Body and query values are merged
+	r := formRequest(t, "/submit?name=query&page=2", "application/x-www-form-urlencoded", "name=J%C3%B6rg&tags=a&tags=b+c")
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, []string{"Jörg", "query"}, r.Form["name"])
+	assert.Equal(t, "Jörg", r.FormValue("name"))
+	assert.Equal(t, "2", r.FormValue("page"))
+	assert.Equal(t, "", r.PostFormValue("page"))
+	assert.Equal(t, []string{"a", "b c"}, r.PostForm["tags"])
+
+	// Test: Invalid encoding
+	r = formRequest(t, "/submit", "application/x-www-form-urlencoded", "name=%zz")
+	assert.Equal(t, ERROR_MALFORMED_FORM, r.ParseForm())
+
+	// Test: Field too large
+	r = formRequest(t, "/submit", "application/x-www-form-urlencoded", "name=0123456789")
+	r.FormLimits.MaxFieldSize = 5
+	assert.Equal(t, ERROR_FIELD_TOO_LARGE, r.ParseForm())
+
+	// Test: Body too large
+	r = formRequest(t, "/submit", "application/x-www-form-urlencoded", "name=0123456789")
+	r.FormLimits.MaxTotalSize = 5
+	assert.Equal(t, ERROR_FORM_TOO_LARGE, r.ParseForm())
+
+	// Test: Other content types only get query values
+	r = formRequest(t, "/submit?a=1", "application/json", "{}")
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "1", r.FormValue("a"))
+	assert.Len(t, r.PostForm, 0)
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	// Test: Small files stay in memory, larger ones spill to disk
+	r := formRequest(t, "/upload?album=2024", "multipart/form-data; boundary=xyz", multipartBody)
+	r.FormLimits.MaxMemory = 16
+	require.NoError(t, r.ParseMultipartForm())
+
+	assert.Equal(t, "holiday", r.FormValue("title"))
+	assert.Equal(t, "2024", r.FormValue("album"))
+
+	files := r.MultipartForm.File["photo"]
+	require.Len(t, files, 2)
+	assert.Equal(t, "beach.jpg", files[0].Filename)
+	assert.Equal(t, int64(10), files[0].Size)
+	contentType, _ := files[0].Header.Get("Content-Type")
+	assert.Equal(t, "image/jpeg", contentType)
+	assert.Equal(t, "", files[0].tmpFile)
+
+	assert.Equal(t, "pier.jpg", files[1].Filename)
+	assert.Equal(t, int64(26), files[1].Size)
+	require.NotEqual(t, "", files[1].tmpFile)
+
+	f, err := files[1].Open()
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", string(data))
+
+	fh, err := r.FormFile("photo")
+	require.NoError(t, err)
+	assert.Equal(t, "beach.jpg", fh.Filename)
+	_, err = r.FormFile("missing")
+	assert.Equal(t, ERROR_MISSING_FILE, err)
+
+	// Test: Cleanup removes temporary files
+	tmp := files[1].tmpFile
+	require.NoError(t, r.Cleanup())
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: Part too large
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	r.FormLimits.MaxPartSize = 20
+	assert.Equal(t, ERROR_PART_TOO_LARGE, r.ParseMultipartForm())
+
+	// Test: Field too large
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	r.FormLimits.MaxFieldSize = 3
+	assert.Equal(t, ERROR_FIELD_TOO_LARGE, r.ParseMultipartForm())
+
+	// Test: Total too large
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	r.FormLimits.MaxTotalSize = 64
+	assert.Equal(t, ERROR_FORM_TOO_LARGE, r.ParseMultipartForm())
+
+	// Test: Not multipart
+	r = formRequest(t, "/upload", "text/plain", "hi")
+	assert.Equal(t, ERROR_NOT_MULTIPART, r.ParseMultipartForm())
+
+	// Test: Truncated body
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", strings.TrimSuffix(multipartBody, "--xyz--\r\n"))
+	assert.Equal(t, ERROR_MALFORMED_FORM, r.ParseMultipartForm())
+}
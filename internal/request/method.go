@@ -0,0 +1,70 @@
+package request
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	MethodGet     = "GET"
+	MethodHead    = "HEAD"
+	MethodPost    = "POST"
+	MethodPut     = "PUT"
+	MethodDelete  = "DELETE"
+	MethodConnect = "CONNECT"
+	MethodOptions = "OPTIONS"
+	MethodTrace   = "TRACE"
+	MethodPatch   = "PATCH"
+)
+
+var ERROR_METHOD_NOT_IMPLEMENTED = fmt.Errorf("Method not implemented")
+
+// Method describes the semantics of a request method (RFC 9110 section 9).
+type Method struct {
+	Name string
+	// Safe methods are read only
+	Safe bool
+	// Idempotent methods can be retried without changing the outcome
+	Idempotent bool
+}
+
+var methodsMu sync.RWMutex
+var methods = map[string]Method{
+	MethodGet:     {Name: MethodGet, Safe: true, Idempotent: true},
+	MethodHead:    {Name: MethodHead, Safe: true, Idempotent: true},
+	MethodPost:    {Name: MethodPost},
+	MethodPut:     {Name: MethodPut, Idempotent: true},
+	MethodDelete:  {Name: MethodDelete, Idempotent: true},
+	MethodConnect: {Name: MethodConnect},
+	MethodOptions: {Name: MethodOptions, Safe: true, Idempotent: true},
+	MethodTrace:   {Name: MethodTrace, Safe: true, Idempotent: true},
+	MethodPatch:   {Name: MethodPatch},
+}
+
+// RegisterMethod adds an extension method, such as the WebDAV ones, so
+// requests using it reach handlers instead of getting 501.
+func RegisterMethod(m Method) {
+	methodsMu.Lock()
+	defer methodsMu.Unlock()
+
+	methods[m.Name] = m
+}
+
+// LookupMethod finds a registered method. Method names are case sensitive.
+func LookupMethod(name string) (Method, bool) {
+	methodsMu.RLock()
+	defer methodsMu.RUnlock()
+
+	m, ok := methods[name]
+	return m, ok
+}
+
+func IsSafe(method string) bool {
+	m, ok := LookupMethod(method)
+	return ok && m.Safe
+}
+
+func IsIdempotent(method string) bool {
+	m, ok := LookupMethod(method)
+	return ok && m.Idempotent
+}
@@ -0,0 +1,62 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMethods(t *testing.T) {
+	assert.True(t, IsSafe(MethodGet))
+	assert.True(t, IsIdempotent(MethodPut))
+	assert.False(t, IsSafe(MethodPut))
+	assert.False(t, IsIdempotent(MethodPost))
+	assert.False(t, IsSafe("get"))
+
+	// Test: Unknown methods are not implemented
+	_, err := RequestFromReader(&chunkReader{
+		data:            "PROPFIND / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	assert.Equal(t, ERROR_METHOD_NOT_IMPLEMENTED, err)
+
+	// Test: Methods are case sensitive
+	_, err = RequestFromReader(&chunkReader{
+		data:            "get / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	assert.Equal(t, ERROR_METHOD_NOT_IMPLEMENTED, err)
+
+	// Test: Registered extension methods are accepted
+	RegisterMethod(Method{Name: "PROPFIND", Safe: true, Idempotent: true})
+	r, err := RequestFromReader(&chunkReader{
+		data:            "PROPFIND / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "PROPFIND", r.RequestLine.Method)
+	assert.True(t, IsSafe("PROPFIND"))
+}
+
+func TestRequestLineStrict(t *testing.T) {
+	invalid := []string{
+		"GET  / HTTP/1.1",
+		" GET / HTTP/1.1",
+		"GET / HTTP/1.1 ",
+		"GET\t/ HTTP/1.1",
+		" / HTTP/1.1",
+		"G(T / HTTP/1.1",
+		"GE\x01T / HTTP/1.1",
+		"GET  HTTP/1.1",
+		"GET / http/1.1",
+	}
+
+	for _, line := range invalid {
+		_, err := RequestFromReader(&chunkReader{
+			data:            line + "\r\nHost: localhost\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		assert.Equal(t, ERROR_MALFORMED_REQUEST_LINE, err, "%q", line)
+	}
+}
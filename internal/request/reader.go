@@ -0,0 +1,120 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Unread body bytes we are willing to throw away to reach the next request
+const maxDrainSize = 256 << 10
+
+var ERROR_BODY_NOT_CONSUMED = fmt.Errorf("Previous request body was not consumed")
+
+// Reader reads consecutive requests from one connection. Bytes read past
+// the end of a request stay buffered for the next one, so pipelined
+// requests are not lost.
+type Reader struct {
+	br   *bufio.Reader
+	last *Request
+}
+
+// Connection buffers are reused once their connection is done with them
+var readerPool = sync.Pool{
+	New: func() any {
+		return bufio.NewReaderSize(nil, maxHeadSize)
+	},
+}
+
+func NewReader(r io.Reader) *Reader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+
+	return &Reader{br: br}
+}
+
+// Release returns the buffer to the pool. Neither the Reader nor the body
+// of a request it returned may be read afterwards.
+func (r *Reader) Release() {
+	if r.br == nil {
+		return
+	}
+
+	r.br.Reset(nil)
+	readerPool.Put(r.br)
+	r.br = nil
+	if r.last != nil {
+		r.last.Release()
+		r.last = nil
+	}
+}
+
+// discard reads whatever is left of the previous request's body. A body
+// the client is still holding back for 100 Continue cannot be skipped.
+func (r *Reader) discard() error {
+	if r.last == nil || r.last.State == StateDone {
+		return nil
+	}
+
+	if r.last.AwaitingContinue() {
+		return ERROR_BODY_NOT_CONSUMED
+	}
+
+	// Stop the 100 Continue hook firing for a body nobody wants
+	r.last.OnBodyRead(nil)
+
+	// Nobody looks at a skipped body, so whether it matches its digest
+	// doesn't matter
+	n, err := io.CopyN(io.Discard, r.last.BodyReader(), maxDrainSize+1)
+	var digestErr *DigestError
+	if err != nil && err != io.EOF && !errors.As(err, &digestErr) {
+		return err
+	}
+	if n > maxDrainSize {
+		return ERROR_BODY_NOT_CONSUMED
+	}
+
+	return nil
+}
+
+// Next returns the next request on the connection, skipping the unread
+// part of the previous body. It returns io.EOF if the connection was
+// closed cleanly between requests. Calling Release on the request once
+// done with it lets a later one reuse its memory.
+func (r *Reader) Next() (*Request, error) {
+	if err := r.discard(); err != nil {
+		return nil, err
+	}
+	if r.last != nil {
+		r.last.Release()
+		r.last = nil
+	}
+
+	// Empty lines before a request line are ignored (RFC 9112 2.2)
+	for {
+		data, err := r.br.Peek(len(SEPARATOR))
+		if err != nil || !bytes.Equal(data, SEPARATOR) {
+			break
+		}
+		r.br.Discard(len(SEPARATOR))
+	}
+
+	req, err := readHead(r.br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Kept until the next request, whose start is where its body ends
+	req.retain()
+	r.last = req
+	return req, nil
+}
+
+// Buffered returns the bytes read from the connection but not yet parsed.
+func (r *Reader) Buffered() []byte {
+	data, _ := r.br.Peek(r.br.Buffered())
+	return data
+}
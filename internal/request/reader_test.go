@@ -0,0 +1,122 @@
+package request
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderPipelined(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"\r\n" +
+			"POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+			"POST /three HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n" +
+			"GET /four HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+
+	r, err := reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/one", r.Path())
+	assert.True(t, r.KeepAlive())
+
+	// Test: An unread body is skipped
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.Path())
+
+	// Test: Chunked body with trailers
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/three", r.Path())
+	assert.Equal(t, int64(-1), r.ContentLength())
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+	sum, _ := r.Trailers.Get("x-sum")
+	assert.Equal(t, "1", sum)
+
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/four", r.Path())
+	assert.False(t, r.KeepAlive())
+
+	// Test: Clean end of the connection
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderFraming(t *testing.T) {
+	invalid := map[string]error{
+		"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n": ERROR_CONFLICTING_FRAMING,
+		"Transfer-Encoding: gzip\r\n":                         ERROR_UNSUPPORTED_TRANSFER_ENCODING,
+		"Transfer-Encoding: chunked, gzip\r\n":                ERROR_UNSUPPORTED_TRANSFER_ENCODING,
+		"Content-Length: -1\r\n":                              ERROR_INVALID_CONTENT_LENGTH,
+		"Content-Length: 1e3\r\n":                             ERROR_INVALID_CONTENT_LENGTH,
+		"Content-Length: 5\r\nContent-Length: 6\r\n":          ERROR_INVALID_CONTENT_LENGTH,
+		"Content-Length: 5, 6\r\n":                            ERROR_INVALID_CONTENT_LENGTH,
+	}
+
+	for fields, expected := range invalid {
+		_, err := NewReader(&chunkReader{
+			data:            "POST / HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\n",
+			numBytesPerRead: 5,
+		}).Next()
+		assert.Equal(t, expected, err, fields)
+	}
+
+	// Test: Repeated identical lengths are fine
+	r, err := NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5, 5\r\n\r\nhello",
+		numBytesPerRead: 5,
+	}).Next()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), r.ContentLength())
+
+	// Test: Connection closed mid request
+	_, err = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: loc",
+		numBytesPerRead: 5,
+	}).Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderRelease(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nHost: localhost\r\nX-Id: abcdef\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /two HTTP/1.1\r\nHost: localhost\r\nX-Id: other!\r\n\r\n" +
+			"GET /three HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	defer reader.Release()
+
+	// Test: A request released before its body was read is still skipped
+	r, err := reader.Next()
+	require.NoError(t, err)
+	path := r.Path()
+	id, _ := r.Headers.Get("X-Id")
+	r.Release()
+
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.Path())
+
+	// Test: Strings taken from a released request don't change when its
+	// memory is reused
+	assert.Equal(t, "/one", path)
+	assert.Equal(t, "abcdef", id)
+
+	// Test: A request that isn't released keeps its strings
+	kept := r
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/three", r.Path())
+	assert.Equal(t, "/two", kept.Path())
+	assert.Equal(t, "/two", kept.RequestLine.RequestTarget)
+	host, _ := kept.Headers.Get("host")
+	assert.Equal(t, "localhost", host)
+}
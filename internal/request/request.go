@@ -1,11 +1,17 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"strconv"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"go.serve/internal/cookie"
 	"go.serve/internal/headers"
 )
 
@@ -15,44 +21,218 @@ type RequestLine struct {
 	HttpVersion   string
 }
 
+// Version splits HttpVersion into its major and minor digits, returning
+// false if it is not of the form DIGIT "." DIGIT.
+func (r *RequestLine) Version() (int, int, bool) {
+	return splitVersion(r.HttpVersion)
+}
+
+// splitVersion also reads the version of a request line still in the
+// connection buffer.
+func splitVersion[T string | []byte](v T) (int, int, bool) {
+	if len(v) != 3 || v[1] != '.' ||
+		v[0] < '0' || v[0] > '9' || v[2] < '0' || v[2] > '9' {
+		return 0, 0, false
+	}
+
+	return int(v[0] - '0'), int(v[2] - '0'), true
+}
+
+// ValidHTTP accepts HTTP/1.x. A minor version above 1 is treated as 1.1,
+// the highest we implement (RFC 9110 section 2.5).
 func (r *RequestLine) ValidHTTP() bool {
-	return r.HttpVersion == "1.1"
+	major, _, ok := r.Version()
+	return ok && major == 1
+}
+
+func (r *RequestLine) IsHTTP10() bool {
+	major, minor, _ := r.Version()
+	return major == 1 && minor == 0
 }
 
 type Request struct {
 	RequestLine RequestLine
+	Target      Target
 	State       parserState
 	Headers     headers.Headers
-	Body        []byte
+	// RemoteAddr is the client's address, set by the server
+	RemoteAddr string
+	// Body holds the request body once it has been read with ReadBody,
+	// which RequestFromReader does. The server leaves it to the handler,
+	// so that it can stream the body or answer Expect: 100-continue first.
+	Body []byte
+	// Trailers sent after a chunked body, filled in once it is read
+	Trailers headers.Headers
+
+	// Populated by ParseForm and ParseMultipartForm
+	Form          url.Values
+	PostForm      url.Values
+	MultipartForm *MultipartForm
+	FormLimits    FormLimits
+
+	chunked       bool
+	contentLength int64
+	body          *body
+	ctx           context.Context
+	// shared with copies made by WithContext so the server can remove
+	// temporary files created further down the handler chain
+	cleanup *[]func() error
+	// how far parse got through a head that is still arriving
+	scan headScan
+	// nil for requests not read by a Reader
+	pooled *pooledRequest
 }
 
-func (r *Request) hasBody() bool {
-	length := getInt(r.Headers, "content-length", 0)
-	return length > 0
+// pooledRequest is a request kept for reuse, along with the storage of its
+// field list. It goes back to the pool once both the caller of Reader.Next
+// and the Reader, which skips what is left of the body before the next
+// request, are done with it.
+type pooledRequest struct {
+	req  Request
+	refs atomic.Int32
 }
 
-func getInt(headers headers.Headers, name string, defaultValue int) int {
-	valueStr, ok := headers.Get(name)
-	if !ok {
-		return defaultValue
+var requestPool = sync.Pool{
+	New: func() any {
+		p := &pooledRequest{}
+		p.req.pooled = p
+		return p
+	},
+}
+
+// Release lets the next request read from the connection reuse this one.
+// It is called once, on the request or any copy of it, after which none
+// of them may be used. Strings taken from the request stay valid.
+func (r *Request) Release() {
+	p := r.pooled
+	if p == nil || p.refs.Add(-1) != 0 {
+		return
 	}
 
-	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		return defaultValue
+	// The field list keeps its storage for the next head
+	fields := p.req.Headers
+	fields.Reset()
+	p.req = Request{Headers: fields, pooled: p}
+	requestPool.Put(p)
+}
+
+func (r *Request) retain() {
+	if r.pooled != nil {
+		r.pooled.refs.Add(1)
+	}
+}
+
+// Cleanup releases resources created while handling the request, such as
+// the temporary files of a multipart form.
+func (r *Request) Cleanup() error {
+	if r.cleanup == nil {
+		return nil
 	}
 
-	return value
+	var err error
+	for _, fn := range *r.cleanup {
+		if fnErr := fn(); fnErr != nil && err == nil {
+			err = fnErr
+		}
+	}
+	*r.cleanup = nil
+	return err
 }
 
-func newRequest() *Request {
-	return &Request{
-		State:   StateInit,
-		Headers: *headers.NewHeaders(),
+func (r *Request) onCleanup(fn func() error) {
+	if r.cleanup == nil {
+		r.cleanup = &[]func() error{}
+	}
+
+	*r.cleanup = append(*r.cleanup, fn)
+}
+
+// Path is the percent-decoded path of the request target.
+func (r *Request) Path() string {
+	return r.Target.Path
+}
+
+func (r *Request) RawPath() string {
+	return r.Target.RawPath
+}
+
+// Query is the parsed query string, empty but never nil if there is none.
+func (r *Request) Query() url.Values {
+	if r.Target.Query == nil {
+		r.Target.Query = url.Values{}
+	}
+	return r.Target.Query
+}
+
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
 	}
+
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of the request using ctx, so
+// middleware can pass values down to the next handler.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	// The copy has to share the list to clean up
+	if r.cleanup == nil {
+		r.cleanup = &[]func() error{}
+	}
+
+	r2 := *r
+	r2.ctx = ctx
+
+	return &r2
+}
+
+// KeepAlive reports whether the client allows the connection to be reused
+// after this request. HTTP/1.0 connections close unless the client opts in
+// with Connection: keep-alive.
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+
+	if r.RequestLine.IsHTTP10() {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+
+	return true
+}
+
+func (r *Request) HasBody() bool {
+	return r.chunked || r.contentLength > 0
+}
+
+// Cookies parses every cookie sent in the Cookie header(s).
+func (r *Request) Cookies() []*cookie.Cookie {
+	cookies := []*cookie.Cookie{}
+	for _, line := range r.Headers.Values("cookie") {
+		cookies = append(cookies, cookie.Parse(line)...)
+	}
+
+	return cookies
+}
+
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	return nil, cookie.ERROR_NO_COOKIE
+}
+
+func newRequest() *Request {
+	p := requestPool.Get().(*pooledRequest)
+	p.refs.Store(1)
+	return &p.req
 }
 
 var ERROR_MALFORMED_REQUEST_LINE = fmt.Errorf("Malformed request line")
+var ERROR_HTTP_VERSION_NOT_SUPPORTED = fmt.Errorf("HTTP version not supported")
 var REQUEST_IN_ERROR_STATE = fmt.Errorf("Request in error state")
 
 var SEPARATOR = []byte("\r\n")
@@ -67,126 +247,256 @@ const (
 	StateError   parserState = 4
 )
 
-func parseRequestLine(b []byte) (*RequestLine, int, error) {
-	idx := bytes.Index(b, SEPARATOR)
-	if idx == -1 {
-		return nil, 0, nil
+// internMethod returns the constant for a standard method so requests
+// don't keep their own copy.
+func internMethod(method string) string {
+	switch method {
+	case MethodGet:
+		return MethodGet
+	case MethodHead:
+		return MethodHead
+	case MethodPost:
+		return MethodPost
+	case MethodPut:
+		return MethodPut
+	case MethodDelete:
+		return MethodDelete
+	case MethodConnect:
+		return MethodConnect
+	case MethodOptions:
+		return MethodOptions
+	case MethodTrace:
+		return MethodTrace
+	case MethodPatch:
+		return MethodPatch
 	}
+	return method
+}
 
-	startLine := b[:idx]
-	read := idx + len(SEPARATOR)
+func internVersion(version string) string {
+	switch version {
+	case "1.1":
+		return "1.1"
+	case "1.0":
+		return "1.0"
+	}
+	return version
+}
 
-	parts := bytes.Split(startLine, []byte(" "))
-	if len(parts) != 3 {
-		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
+// headScan is where parse left off in a head still arriving. The request
+// line is checked as soon as it is complete and the offsets of its parts
+// kept, the field lines are only counted until the head ends.
+type headScan struct {
+	scanned   int
+	methodEnd int
+	targetEnd int
+}
+
+// parseRequestLine checks line, without its CRLF, while it is still in the
+// connection buffer, and returns where the method and the target end.
+func parseRequestLine(line []byte) (int, int, error) {
+	// Exactly one space between the parts, no leading or trailing spaces
+	methodEnd := bytes.IndexByte(line, ' ')
+	if methodEnd == -1 {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
+	targetEnd := bytes.IndexByte(line[methodEnd+1:], ' ')
+	if targetEnd == -1 {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
+	targetEnd += methodEnd + 1
+
+	method := line[:methodEnd]
+	target := line[methodEnd+1 : targetEnd]
+	version := line[targetEnd+1:]
+	if bytes.IndexByte(version, ' ') != -1 {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
-	httpParts := bytes.Split(parts[2], []byte("/"))
-	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" {
-		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
+	if !headers.IsToken(method) || len(target) == 0 {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
-	rl := &RequestLine{
-		Method:        string(parts[0]),
-		RequestTarget: string(parts[1]),
-		HttpVersion:   string(httpParts[1]),
+	version, ok := bytes.CutPrefix(version, []byte("HTTP/"))
+	if !ok || bytes.IndexByte(version, '/') != -1 {
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
 	}
 
-	if !rl.ValidHTTP() {
-		return nil, 0, ERROR_MALFORMED_REQUEST_LINE
+	if major, _, ok := splitVersion(version); !ok || major != 1 {
+		// HTTP/2 and later have their own framing, so this is a well
+		// formed request for a version we don't speak
+		if ok && major > 1 {
+			return 0, 0, ERROR_HTTP_VERSION_NOT_SUPPORTED
+		}
+		return 0, 0, ERROR_MALFORMED_REQUEST_LINE
+	}
+
+	if _, ok := LookupMethod(string(method)); !ok {
+		return 0, 0, ERROR_METHOD_NOT_IMPLEMENTED
 	}
-	return rl, read, nil
+
+	return methodEnd, targetEnd, nil
 }
 
+// parse advances the state machine over data, the head received so far
+// from its first byte. Nothing is copied while the head arrives. Once the
+// empty line ending it is found, the head is copied out of data in one
+// go, as a string the request line and fields are substrings of. It
+// returns the length of the head once it is complete, 0 until then.
 func (r *Request) parse(data []byte) (int, error) {
-
-	read := 0
-outer:
 	for {
-		currentData := data[read:]
-		if len(currentData) == 0 {
-			break outer
-		}
+		currentData := data[r.scan.scanned:]
 		switch r.State {
 		case StateError:
 			return 0, REQUEST_IN_ERROR_STATE
 		case StateInit:
-			rl, n, err := parseRequestLine(currentData)
-			if err != nil {
-				return 0, err
+			idx := bytes.Index(currentData, SEPARATOR)
+			if idx == -1 {
+				return 0, nil
 			}
 
-			if n == 0 {
-				break outer
-			}
-
-			r.RequestLine = *rl
-			read += n
-
-			r.State = StateHeaders
-		case StateHeaders:
-			n, done, err := r.Headers.Parse(currentData)
+			// A bad request line is reported without waiting for the rest
+			methodEnd, targetEnd, err := parseRequestLine(currentData[:idx])
 			if err != nil {
 				return 0, err
 			}
 
-			if n == 0 {
-				break outer
+			r.scan.methodEnd = methodEnd
+			r.scan.targetEnd = targetEnd
+			r.scan.scanned += idx + len(SEPARATOR)
+			r.State = StateHeaders
+		case StateHeaders:
+			idx := bytes.Index(currentData, SEPARATOR)
+			if idx == -1 {
+				return 0, nil
 			}
 
-			read += n
+			r.scan.scanned += idx + len(SEPARATOR)
 
-			if done {
-				if r.hasBody() {
-					r.State = StateBody
-				} else {
-					r.State = StateDone
-				}
+			// Field lines are parsed together once the head is complete
+			if idx > 0 {
+				continue
 			}
 
-		case StateBody:
-			length := getInt(r.Headers, "Content-Length", 0)
-
-			remaining := min(length-len(r.Body), len(currentData))
-			r.Body = append(r.Body, currentData[:remaining]...)
-			read += remaining
-
-			if len(r.Body) == length {
-				r.State = StateDone
+			if err := r.parseHead(string(data[:r.scan.scanned])); err != nil {
+				return 0, err
 			}
+			return r.scan.scanned, nil
 
+		case StateBody:
+			// The body is streamed by BodyReader, not parsed here
+			return 0, nil
 		case StateDone:
-			break outer
+			return 0, nil
 		default:
 			panic("Something went wrong...")
 		}
 	}
-	return read, nil
 }
 
-func (r *Request) done() bool {
-	return r.State == StateDone || r.State == StateError
+// parseHead parses a complete request head, from the request line to the
+// empty line ending the fields, whose request line parse already checked.
+func (r *Request) parseHead(head string) error {
+	line, fields, _ := strings.Cut(head, "\r\n")
+
+	rl := RequestLine{
+		Method:        internMethod(line[:r.scan.methodEnd]),
+		RequestTarget: line[r.scan.methodEnd+1 : r.scan.targetEnd],
+		HttpVersion:   internVersion(line[r.scan.targetEnd+len(" HTTP/"):]),
+	}
+
+	target, err := parseTarget(rl.Method, rl.RequestTarget)
+	if err != nil {
+		return err
+	}
+
+	r.RequestLine = rl
+	r.Target = target
+
+	if err := r.Headers.ParseFieldLines(fields); err != nil {
+		return err
+	}
+
+	if err := r.parseFraming(); err != nil {
+		return err
+	}
+
+	if r.HasBody() {
+		r.State = StateBody
+	} else {
+		r.State = StateDone
+	}
+	return nil
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
+func (r *Request) headDone() bool {
+	return r.State == StateBody || r.State == StateDone || r.State == StateError
+}
+
+// Requests with a larger request line and header section are rejected
+const maxHeadSize = 8192
+
+var ERROR_HEADERS_TOO_LARGE = fmt.Errorf("Request header section too large")
+
+// readHead parses the request line and headers from br, leaving the body
+// unread in the buffer. The head stays in the buffer until it is complete
+// and is then copied out once, which together with the pooled request
+// makes that copy the only allocation of a request without a body.
+func readHead(br *bufio.Reader) (*Request, error) {
 	request := newRequest()
 
-	buf := make([]byte, 1024)
-	bufLen := 0
-	for !request.done() {
-		n, err := reader.Read(buf[bufLen:])
+	for !request.headDone() {
+		data, err := br.Peek(br.Buffered())
 		if err != nil {
+			request.Release()
 			return nil, err
 		}
 
-		bufLen += n
-		readN, err := request.parse(buf[:bufLen])
+		readN, err := request.parse(data)
 		if err != nil {
+			request.Release()
 			return nil, err
 		}
+		if request.headDone() {
+			br.Discard(readN)
+			break
+		}
+
+		// Wait for at least one more byte than we already have
+		_, err = br.Peek(br.Buffered() + 1)
+		if err == bufio.ErrBufferFull {
+			err = ERROR_HEADERS_TOO_LARGE
+		}
+		if err == io.EOF && br.Buffered() > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			request.Release()
+			return nil, err
+		}
+	}
+
+	if request.HasBody() {
+		request.body = newBody(request, br)
+	}
+	return request, nil
+}
+
+// HeadFromReader parses the request line and headers and returns a request
+// whose body is read from reader on demand through BodyReader or ReadBody.
+func HeadFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).Next()
+}
+
+// RequestFromReader parses a whole request, including its body.
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	request, err := HeadFromReader(reader)
+	if err != nil {
+		return nil, err
+	}
 
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
+	if _, err := request.ReadBody(); err != nil {
+		return nil, err
 	}
 
 	return request, nil
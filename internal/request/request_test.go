@@ -2,6 +2,7 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -126,3 +127,295 @@ func TestBodyParse(t *testing.T) {
 	require.Error(t, err)
 
 }
+
+func TestRequestCookies(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nCookie: a=1; b=2\r\nCookie: c=3\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Len(t, r.Cookies(), 3)
+
+	c, err := r.Cookie("c")
+	require.NoError(t, err)
+	assert.Equal(t, "3", c.Value)
+
+	_, err = r.Cookie("missing")
+	require.Error(t, err)
+}
+
+func TestBodyStreaming(t *testing.T) {
+	// Test: The body is not read until asked for
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-continue\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := HeadFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	assert.Equal(t, int64(13), r.ContentLength())
+	assert.Equal(t, StateBody, r.State)
+	assert.Nil(t, r.body.all)
+
+	calls := 0
+	r.OnBodyRead(func() error {
+		calls++
+		return nil
+	})
+
+	body, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, StateDone, r.State)
+
+	// Test: A failing hook fails the read
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err = HeadFromReader(reader)
+	require.NoError(t, err)
+	hookErr := io.ErrClosedPipe
+	r.OnBodyRead(func() error { return hookErr })
+	_, err = r.ReadBody()
+	assert.Equal(t, hookErr, err)
+
+	// Test: ReadBody is shared with copies of the request
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err = HeadFromReader(reader)
+	require.NoError(t, err)
+	r2 := r.WithContext(r.Context())
+	body, err = r2.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	body, err = io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Header section too large
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", maxHeadSize) + "\r\n\r\n",
+		numBytesPerRead: 512,
+	}
+	_, err = HeadFromReader(reader)
+	assert.Equal(t, ERROR_HEADERS_TOO_LARGE, err)
+}
+
+func TestBodyDigest(t *testing.T) {
+	sha256 := "sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:"
+	sha512 := "sha-512=:MJ7MSJwS1utMxA9QyQLytNDtd+5RGnx6m808qG1M2G+YndNbxf9JlnDaNCVbRbDP2DDoH2Bdz33FVC6TrpzXbw==:"
+	post := func(fields, body string) *Request {
+		r, err := HeadFromReader(&chunkReader{
+			data:            "POST /upload HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\n" + body,
+			numBytesPerRead: 4,
+		})
+		require.NoError(t, err)
+		return r
+	}
+	chunkedBody := "6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n"
+
+	// Test: Matching digests, buffered and streamed, fixed length and chunked
+	for _, fields := range []string{
+		"Content-Digest: " + sha256 + "\r\n",
+		"Content-Digest: md5=:abc:, " + sha512 + ", " + sha256 + "\r\n",
+		"Content-MD5: XrY7u+Ae7tCTyyK7j1rNww==\r\n",
+	} {
+		r := post(fields+"Content-Length: 11\r\n", "hello world")
+		body, err := r.ReadBody()
+		require.NoError(t, err, fields)
+		assert.Equal(t, "hello world", string(body))
+		assert.NoError(t, r.BodyError())
+
+		r = post(fields+"Transfer-Encoding: chunked\r\n", chunkedBody)
+		body, err = io.ReadAll(r.BodyReader())
+		require.NoError(t, err, fields)
+		assert.Equal(t, "hello world", string(body))
+	}
+
+	// Test: A mismatch fails the end of the body, however it is read
+	var digestErr *DigestError
+	r := post("Content-Digest: "+sha256+"\r\nContent-Length: 11\r\n", "hello World")
+	_, err := r.ReadBody()
+	require.ErrorAs(t, err, &digestErr)
+	assert.ErrorIs(t, err, ERROR_DIGEST_MISMATCH)
+	assert.Equal(t, "content-digest", digestErr.Field)
+	assert.Equal(t, "sha-256", digestErr.Algorithm)
+	assert.Equal(t, StateDone, r.State)
+	assert.ErrorIs(t, r.BodyError(), ERROR_DIGEST_MISMATCH)
+
+	r = post("Content-MD5: XrY7u+Ae7tCTyyK7j1rNww==\r\nTransfer-Encoding: chunked\r\n", "5\r\nhello\r\n0\r\n\r\n")
+	_, err = io.ReadAll(r.BodyReader())
+	require.ErrorAs(t, err, &digestErr)
+	assert.Equal(t, "content-md5", digestErr.Field)
+
+	// Test: Malformed digests are reported once the body has been read
+	for _, fields := range []string{
+		"Content-Digest: sha-256=uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=\r\n",
+		"Content-Digest: sha-256=:aGVsbG8=:\r\n",
+		"Content-MD5: not base64\r\n",
+	} {
+		r = post(fields+"Content-Length: 11\r\n", "hello world")
+		_, err = r.ReadBody()
+		assert.ErrorIs(t, err, ERROR_MALFORMED_DIGEST, fields)
+		assert.Equal(t, StateDone, r.State)
+	}
+
+	// Test: A skipped body that fails its digest doesn't stop the next request
+	reader := NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nHost: localhost\r\nContent-Digest: " + sha256 + "\r\nContent-Length: 3\r\n\r\nabc" +
+			"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	_, err = reader.Next()
+	require.NoError(t, err)
+	r, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.Path())
+}
+
+func TestRequestVersion(t *testing.T) {
+	// Test: HTTP/1.0 closes by default
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.RequestLine.IsHTTP10())
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive opt in
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Higher HTTP/1 minor versions are accepted
+	r, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.2\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.RequestLine.IsHTTP10())
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/2 over HTTP/1 syntax
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/2.0\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	assert.Equal(t, ERROR_HTTP_VERSION_NOT_SUPPORTED, err)
+
+	// Test: Malformed versions
+	for _, version := range []string{"1", "1.", "11.1", "x.y", "2"} {
+		_, err = RequestFromReader(&chunkReader{
+			data:            "GET / HTTP/" + version + "\r\nHost: localhost\r\n\r\n",
+			numBytesPerRead: 3,
+		})
+		assert.Equal(t, ERROR_MALFORMED_REQUEST_LINE, err, version)
+	}
+
+	// Test: Transfer-Encoding is not allowed in HTTP/1.0
+	_, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	assert.Equal(t, ERROR_TRANSFER_ENCODING_HTTP10, err)
+}
+
+// loopReader serves data over and over, like a client pipelining the same
+// requests forever.
+type loopReader struct {
+	data string
+	pos  int
+}
+
+func (lr *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, lr.data[lr.pos:])
+	lr.pos = (lr.pos + n) % len(lr.data)
+	return n, nil
+}
+
+func benchmarkReader(b *testing.B, raw string, fn func(*Request)) {
+	// Several requests per loop so reads don't line up with request ends
+	reader := NewReader(&loopReader{data: strings.Repeat(raw, 7)})
+	defer reader.Release()
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := reader.Next()
+		if err != nil {
+			b.Fatal(err)
+		}
+		fn(r)
+		r.Release()
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	b.Run("GET", func(b *testing.B) {
+		benchmarkReader(b, "GET /index.html HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0\r\n"+
+			"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n"+
+			"Accept-Language: en-US,en;q=0.5\r\n"+
+			"Accept-Encoding: gzip, deflate, br\r\n"+
+			"Connection: keep-alive\r\n"+
+			"Upgrade-Insecure-Requests: 1\r\n"+
+			"\r\n", func(r *Request) {})
+	})
+
+	b.Run("GET with query", func(b *testing.B) {
+		benchmarkReader(b, "GET /search?q=go+serve&page=2 HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n", func(r *Request) {})
+	})
+
+	b.Run("POST", func(b *testing.B) {
+		benchmarkReader(b, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\nhello world", func(r *Request) {
+			if _, err := r.ReadBody(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	})
+}
+
+func TestReadRequestAllocs(t *testing.T) {
+	// Test: A released GET costs only the copy of its head
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+
+	reader := NewReader(&loopReader{data: "GET /index.html HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\nAccept: */*\r\n\r\n"})
+	defer reader.Release()
+
+	var err error
+	allocs := testing.AllocsPerRun(100, func() {
+		var r *Request
+		r, err = reader.Next()
+		if err == nil {
+			r.Release()
+		}
+	})
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), allocs)
+}
@@ -0,0 +1,270 @@
+package request
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The four request-target forms from RFC 9112 section 3.2
+type TargetForm int
+
+const (
+	FormOrigin    TargetForm = 0
+	FormAbsolute  TargetForm = 1
+	FormAuthority TargetForm = 2
+	FormAsterisk  TargetForm = 3
+)
+
+var ERROR_MALFORMED_REQUEST_TARGET = fmt.Errorf("Malformed request target")
+
+type Target struct {
+	Form TargetForm
+	// Scheme and Authority are only set for absolute-form and
+	// authority-form (Authority only) targets
+	Scheme    string
+	Authority string
+	// Path is percent-decoded, RawPath is the path as it was sent
+	Path     string
+	RawPath  string
+	RawQuery string
+	// Query is nil if there is no query string
+	Query url.Values
+}
+
+// isTargetChar allows the characters of RFC 3986 that may appear in a
+// request-target: unreserved, sub-delims, ":", "@", "/", "?", "%" and the
+// brackets of an IP literal host.
+func isTargetChar(ch byte) bool {
+	if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' {
+		return true
+	}
+
+	switch ch {
+	case '-', '.', '_', '~',
+		'!', '$', '&', '\'', '(', ')', '*', '+', ',', ';', '=',
+		':', '@', '/', '?', '%', '[', ']':
+		return true
+	}
+
+	return false
+}
+
+func validTarget(target string) bool {
+	for i := 0; i < len(target); i++ {
+		if !isTargetChar(target[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func unhex(ch byte) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	}
+
+	return 0, false
+}
+
+// unescape decodes percent-encoded octets, rejecting any '%' that is not
+// followed by two hex digits. In queries '+' is a space.
+func unescape(s string, query bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '%':
+			if i+2 >= len(s) {
+				return "", ERROR_MALFORMED_REQUEST_TARGET
+			}
+			hi, ok1 := unhex(s[i+1])
+			lo, ok2 := unhex(s[i+2])
+			if !ok1 || !ok2 {
+				return "", ERROR_MALFORMED_REQUEST_TARGET
+			}
+			b.WriteByte(hi<<4 | lo)
+			i += 2
+		case '+':
+			if query {
+				b.WriteByte(' ')
+			} else {
+				b.WriteByte('+')
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), nil
+}
+
+func parseQuery(rawQuery string) (url.Values, error) {
+	values := url.Values{}
+
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+		if pair == "" {
+			continue
+		}
+
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err != nil {
+			return nil, err
+		}
+		value, err := unescape(rawValue, true)
+		if err != nil {
+			return nil, err
+		}
+
+		values[key] = append(values[key], value)
+	}
+
+	return values, nil
+}
+
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		alpha := ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+		if i == 0 && !alpha {
+			return false
+		}
+		if !alpha && !(ch >= '0' && ch <= '9') && ch != '+' && ch != '-' && ch != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// authority-form is host ":" port, where host may be an IPv6 literal
+func isAuthority(s string) bool {
+	idx := strings.LastIndexByte(s, ':')
+	if idx <= 0 || idx == len(s)-1 {
+		return false
+	}
+
+	host, port := s[:idx], s[idx+1:]
+	if strings.HasPrefix(host, "[") != strings.HasSuffix(host, "]") {
+		return false
+	}
+	if strings.ContainsAny(host, "/?#@ ") {
+		return false
+	}
+
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *Target) setPath(rawPath string) error {
+	// Brackets are only allowed around an IPv6 host
+	if strings.ContainsAny(rawPath, "[]") {
+		return ERROR_MALFORMED_REQUEST_TARGET
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(rawPath, "?")
+
+	path, err := unescape(rawPath, false)
+	if err != nil {
+		return err
+	}
+
+	if rawQuery != "" {
+		query, err := parseQuery(rawQuery)
+		if err != nil {
+			return err
+		}
+		t.Query = query
+	}
+
+	t.Path = path
+	t.RawPath = rawPath
+	t.RawQuery = rawQuery
+	return nil
+}
+
+func parseTarget(method, target string) (Target, error) {
+	// Fragments are never sent in a request-target, and '#' is not a
+	// target character anyway
+	if target == "" || !validTarget(target) {
+		return Target{}, ERROR_MALFORMED_REQUEST_TARGET
+	}
+
+	t := Target{}
+
+	switch {
+	case method == MethodConnect:
+		if !isAuthority(target) {
+			return Target{}, ERROR_MALFORMED_REQUEST_TARGET
+		}
+		t.Form = FormAuthority
+		t.Authority = target
+		return t, nil
+
+	case target == "*":
+		if method != MethodOptions {
+			return Target{}, ERROR_MALFORMED_REQUEST_TARGET
+		}
+		t.Form = FormAsterisk
+		t.Path = "*"
+		t.RawPath = "*"
+		return t, nil
+
+	case strings.HasPrefix(target, "/"):
+		t.Form = FormOrigin
+		if err := t.setPath(target); err != nil {
+			return Target{}, err
+		}
+		return t, nil
+	}
+
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found || !isScheme(scheme) {
+		return Target{}, ERROR_MALFORMED_REQUEST_TARGET
+	}
+
+	end := strings.IndexAny(rest, "/?")
+	if end == -1 {
+		end = len(rest)
+	}
+
+	authority := rest[:end]
+	if authority == "" || strings.Contains(authority, "@") {
+		return Target{}, ERROR_MALFORMED_REQUEST_TARGET
+	}
+
+	path := rest[end:]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	t.Form = FormAbsolute
+	t.Scheme = strings.ToLower(scheme)
+	t.Authority = authority
+	if err := t.setPath(path); err != nil {
+		return Target{}, err
+	}
+	return t, nil
+}
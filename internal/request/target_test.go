@@ -0,0 +1,97 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetParse(t *testing.T) {
+	// Test: origin-form with query
+	target, err := parseTarget("GET", "/video%20clips/a+b?x=1&x=2&name=J%C3%B6rg+M&flag")
+	require.NoError(t, err)
+	assert.Equal(t, FormOrigin, target.Form)
+	assert.Equal(t, "/video clips/a+b", target.Path)
+	assert.Equal(t, "/video%20clips/a+b", target.RawPath)
+	assert.Equal(t, "x=1&x=2&name=J%C3%B6rg+M&flag", target.RawQuery)
+	assert.Equal(t, []string{"1", "2"}, target.Query["x"])
+	assert.Equal(t, "Jörg M", target.Query.Get("name"))
+	assert.Equal(t, []string{""}, target.Query["flag"])
+
+	// Test: absolute-form
+	target, err = parseTarget("GET", "HTTP://example.com:8080?q=go")
+	require.NoError(t, err)
+	assert.Equal(t, FormAbsolute, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "example.com:8080", target.Authority)
+	assert.Equal(t, "/", target.Path)
+	assert.Equal(t, "go", target.Query.Get("q"))
+
+	// Test: authority-form
+	target, err = parseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, FormAuthority, target.Form)
+	assert.Equal(t, "example.com:443", target.Authority)
+
+	target, err = parseTarget("CONNECT", "[::1]:443")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:443", target.Authority)
+
+	// Test: asterisk-form
+	target, err = parseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, FormAsterisk, target.Form)
+
+	// Test: Invalid targets
+	invalid := []struct{ method, target string }{
+		{"GET", "/bad%2"},
+		{"GET", "/bad%zz"},
+		{"GET", "/?q=%g0"},
+		{"GET", "/page#section"},
+		{"GET", "*"},
+		{"GET", "example.com:443"},
+		{"GET", "http://user@example.com/"},
+		{"GET", "http:///nohost"},
+		{"CONNECT", "/"},
+		{"CONNECT", "example.com"},
+		{"CONNECT", "example.com:https"},
+		{"GET", "/with space"},
+		{"GET", "/tab\there"},
+		{"GET", "/quote\"d"},
+		{"GET", "/<script>"},
+		{"GET", "/back\\slash"},
+		{"GET", "/caret^"},
+		{"GET", "/pipe|"},
+		{"GET", "/curly{}"},
+		{"GET", "/café"},
+		{"GET", "/null\x00"},
+		{"GET", "/brackets[]"},
+		{"GET", "/?q=[]"},
+	}
+	for _, tc := range invalid {
+		_, err := parseTarget(tc.method, tc.target)
+		assert.Equal(t, ERROR_MALFORMED_REQUEST_TARGET, err, "%s %s", tc.method, tc.target)
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	// Test: Query string is split from the path
+	reader := &chunkReader{
+		data:            "GET /video?x=1 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/video?x=1", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/video", r.Path())
+	assert.Equal(t, "1", r.Query().Get("x"))
+
+	// Test: Invalid percent-encoding
+	reader = &chunkReader{
+		data:            "GET /video%G1 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Equal(t, ERROR_MALFORMED_REQUEST_TARGET, err)
+}
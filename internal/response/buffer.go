@@ -0,0 +1,105 @@
+package response
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Size of the buffer a response is gathered in before it goes out
+const bufferSize = 4096
+
+var ERROR_WRITER_RELEASED = fmt.Errorf("Writer has been released")
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, bufferSize)
+	},
+}
+
+// releasedWriter stands in for the buffer once it went back to the pool.
+type releasedWriter struct{}
+
+func (releasedWriter) Write(b []byte) (int, error) {
+	return 0, ERROR_WRITER_RELEASED
+}
+
+// NewBufferedWriter is NewWriter with the response gathered in a pooled
+// buffer, so the status line and headers go out in one write instead of
+// one per line. Nothing reaches writer until the buffer fills or Flush is
+// called. Release hands the buffer back once the response is done.
+func NewBufferedWriter(writer io.Writer) *Writer {
+	bw := bufferPool.Get().(*bufio.Writer)
+	bw.Reset(writer)
+
+	w := NewWriter(bw)
+	w.buffer = bw
+	w.dst = writer
+	return w
+}
+
+// Flush sends whatever is buffered. Streaming handlers call it whenever
+// the client should see what was written so far.
+func (w *Writer) Flush() error {
+	if w.buffer == nil {
+		return nil
+	}
+	return w.buffer.Flush()
+}
+
+// Release flushes and returns the buffer to the pool. The Writer can't be
+// written to afterwards. The server calls it once the handler returns.
+func (w *Writer) Release() error {
+	hookErr := w.runBeforeFinish()
+	if w.buffer == nil {
+		return hookErr
+	}
+
+	err := w.buffer.Flush()
+	if err == nil {
+		err = hookErr
+	}
+	w.buffer.Reset(nil)
+	bufferPool.Put(w.buffer)
+	w.buffer = nil
+	w.writer = releasedWriter{}
+	w.dst = releasedWriter{}
+	return err
+}
+
+// writeString writes parts as one piece of output. Into the buffer they are
+// copied one by one, which allocates nothing; an unbuffered writer gets
+// them joined, so a line is still a single write.
+func (w *Writer) writeString(parts ...string) (int, error) {
+	if w.buffer == nil {
+		return io.WriteString(w.writer, strings.Join(parts, ""))
+	}
+
+	n := 0
+	for _, part := range parts {
+		m, err := w.buffer.WriteString(part)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeChunkSize writes the line starting a chunk of size bytes.
+func (w *Writer) writeChunkSize(size int, extensions string) (int, error) {
+	if w.buffer == nil {
+		return w.writeString(strconv.FormatInt(int64(size), 16), extensions, "\r\n")
+	}
+
+	// Formatted straight into the free part of the buffer
+	n, err := w.buffer.Write(strconv.AppendInt(w.buffer.AvailableBuffer(), int64(size), 16))
+	if err != nil {
+		return n, err
+	}
+	m, err := w.writeString(extensions, "\r\n")
+	return n + m, err
+}
@@ -0,0 +1,117 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingWriter counts the writes that would each be a syscall on a
+// connection.
+type countingWriter struct {
+	writes int
+	sb     strings.Builder
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.writes++
+	return c.sb.Write(b)
+}
+
+func writeResponse(w *Writer) {
+	h := GetDefaultHeaders(5)
+	for _, name := range []string{"X-One", "X-Two", "X-Three", "X-Four", "X-Five", "X-Six", "X-Seven", "X-Eight"} {
+		h.Set(name, "value")
+	}
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("hello"))
+}
+
+func TestBufferedWriter(t *testing.T) {
+	// Test: The whole response goes out in one write
+	var out countingWriter
+	w := NewBufferedWriter(&out)
+	writeResponse(w)
+	assert.Equal(t, 0, out.writes)
+	require.NoError(t, w.Release())
+	assert.Equal(t, 1, out.writes)
+	assert.True(t, strings.HasPrefix(out.sb.String(), "HTTP/1.1 200 OK \r\n"))
+	assert.True(t, strings.HasSuffix(out.sb.String(), "\r\n\r\nhello"))
+
+	// Test: A released writer can't be written to
+	w = NewBufferedWriter(&out)
+	w.Release()
+	assert.ErrorIs(t, w.WriteStatusLine(StatusOK), ERROR_WRITER_RELEASED)
+
+	// Test: Flush lets streamed chunks through as they are written
+	out = countingWriter{}
+	w = NewBufferedWriter(&out)
+	w = chunkedWriterFrom(t, w, &strings.Builder{}, "")
+	w.WriteChunkedBody([]byte("first"))
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(out.sb.String(), "5\r\nfirst\r\n"), out.sb.String())
+	w.WriteChunkedBody([]byte("second"))
+	assert.NotContains(t, out.sb.String(), "second")
+	w.WriteChunkedBodyDone()
+	w.Finish()
+	w.Release()
+	assert.True(t, strings.HasSuffix(out.sb.String(), "6\r\nsecond\r\n0\r\n\r\n"))
+
+	// Test: 100 Continue is not held back
+	out = countingWriter{}
+	w = NewBufferedWriter(&out)
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", out.sb.String())
+	w.Release()
+
+	// Test: BeforeFinish runs once, while the buffer can still be written
+	out = countingWriter{}
+	w = NewBufferedWriter(&out)
+	w = chunkedWriterFrom(t, w, &strings.Builder{}, "")
+	calls := 0
+	w.BeforeFinish(func() error {
+		calls++
+		_, err := w.WriteChunkedBodyDone()
+		return err
+	})
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Release())
+	assert.Equal(t, 1, calls)
+	assert.True(t, strings.HasSuffix(out.sb.String(), "\r\n0\r\n\r\n"), out.sb.String())
+
+	// Test: Unbuffered writers have nothing to flush
+	out = countingWriter{}
+	w = NewWriter(&out)
+	writeResponse(w)
+	assert.Greater(t, out.writes, 10)
+	assert.NoError(t, w.Flush())
+	assert.NoError(t, w.Release())
+}
+
+// The writes/op metric is the number of writes reaching the connection,
+// each a syscall and usually a TCP segment.
+func BenchmarkWriter(b *testing.B) {
+	for _, bc := range []struct {
+		name      string
+		newWriter func(io.Writer) *Writer
+	}{
+		{"unbuffered", NewWriter},
+		{"buffered", NewBufferedWriter},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			out := &countingWriter{}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := bc.newWriter(out)
+				writeResponse(w)
+				w.Release()
+				out.sb.Reset()
+			}
+			b.ReportMetric(float64(out.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+
+	"go.serve/internal/headers"
+)
+
+// Size of the chunks a ChunkedWriter gathers small writes into by default
+const DefaultChunkSize = 4096
+
+var ERROR_INVALID_CHUNK_EXTENSION = fmt.Errorf("Invalid chunk extension")
+var ERROR_CHUNKED_WRITER_CLOSED = fmt.Errorf("Chunked writer closed")
+
+// ChunkExtension is a chunk-ext parameter sent on a chunk's size line, e.g.
+// ;name=value. Value may be empty.
+type ChunkExtension struct {
+	Name  string
+	Value string
+}
+
+// formatExtensions renders ext as it follows the chunk size, quoting
+// values that are not tokens.
+func formatExtensions(ext []ChunkExtension) (string, error) {
+	var b strings.Builder
+	for _, e := range ext {
+		if !headers.IsToken([]byte(e.Name)) {
+			return "", fmt.Errorf("%w: %q", ERROR_INVALID_CHUNK_EXTENSION, e.Name)
+		}
+		b.WriteString(";" + e.Name)
+
+		if e.Value == "" {
+			continue
+		}
+		if headers.IsToken([]byte(e.Value)) {
+			b.WriteString("=" + e.Value)
+			continue
+		}
+
+		b.WriteString(`="`)
+		for i := 0; i < len(e.Value); i++ {
+			c := e.Value[i]
+			if c < ' ' && c != '\t' || c == 0x7f {
+				return "", fmt.Errorf("%w: %q", ERROR_INVALID_CHUNK_EXTENSION, e.Value)
+			}
+			if c == '"' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('"')
+	}
+	return b.String(), nil
+}
+
+type ChunkedOptions struct {
+	// Writes are gathered until this many bytes are pending before a chunk
+	// is sent. Larger writes go out as they are. Defaults to
+	// DefaultChunkSize.
+	ChunkSize int
+	// Extensions sent with every chunk
+	Extensions []ChunkExtension
+}
+
+// ChunkedWriter streams a chunked body through a Writer whose headers have
+// been written. Small writes are coalesced into larger chunks and empty
+// ones are skipped. The caller's slices are copied, never modified. Close
+// sends what is pending and the last chunk; trailers may still be written
+// on the Writer after it.
+type ChunkedWriter struct {
+	w          *Writer
+	buf        []byte
+	size       int
+	extensions []ChunkExtension
+	closed     bool
+}
+
+func NewChunkedWriter(w *Writer, opts ChunkedOptions) (*ChunkedWriter, error) {
+	if _, err := formatExtensions(opts.Extensions); err != nil {
+		return nil, err
+	}
+
+	size := opts.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+
+	return &ChunkedWriter{
+		w:          w,
+		size:       size,
+		extensions: opts.Extensions,
+	}, nil
+}
+
+func (c *ChunkedWriter) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, ERROR_CHUNKED_WRITER_CLOSED
+	}
+
+	// Nothing is pending and p fills a chunk by itself
+	if len(c.buf) == 0 && len(p) >= c.size {
+		if _, err := c.w.WriteChunk(p, c.extensions...); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, 0, c.size)
+		}
+
+		n := min(len(p), c.size-len(c.buf))
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(c.buf) == c.size {
+			if err := c.sendPending(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// WriteChunk sends what is pending and then p as a chunk of its own with
+// ext on its size line, in addition to the writer's extensions.
+func (c *ChunkedWriter) WriteChunk(p []byte, ext ...ChunkExtension) error {
+	if c.closed {
+		return ERROR_CHUNKED_WRITER_CLOSED
+	}
+
+	if err := c.sendPending(); err != nil {
+		return err
+	}
+
+	_, err := c.w.WriteChunk(p, append(c.extensions[:len(c.extensions):len(c.extensions)], ext...)...)
+	return err
+}
+
+// Flush sends the pending bytes as a chunk and flushes the Writer, so the
+// client sees everything written so far.
+func (c *ChunkedWriter) Flush() error {
+	if err := c.sendPending(); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// sendPending writes the pending bytes to the Writer as a chunk.
+func (c *ChunkedWriter) sendPending() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	_, err := c.w.WriteChunk(c.buf, c.extensions...)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// Close flushes and ends the body with the last chunk.
+func (c *ChunkedWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+
+	if err := c.sendPending(); err != nil {
+		return err
+	}
+
+	c.closed = true
+	_, err := c.w.WriteChunkedBodyDone()
+	return err
+}
@@ -0,0 +1,107 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bodyOf returns what was written after the header section.
+func bodyOf(sb *strings.Builder) string {
+	_, after, _ := strings.Cut(sb.String(), "\r\n\r\n")
+	return after
+}
+
+func TestWriteChunkedBody(t *testing.T) {
+	// Test: The caller's slice is left alone, even with spare capacity
+	var sb strings.Builder
+	w := chunkedWriter(t, &sb, "")
+	backing := []byte("abcdefgh")
+	n, err := w.WriteChunkedBody(backing[:3])
+	require.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, "abcdefgh", string(backing))
+
+	// Test: An empty write is not the last chunk
+	n, err = w.WriteChunkedBody(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	// Test: Without trailers the last chunk ends the response, no Finish
+	// needed
+	w.WriteChunkedBodyDone()
+	assert.Equal(t, "3\r\nabc\r\n0\r\n\r\n", bodyOf(&sb))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "3\r\nabc\r\n0\r\n\r\n", bodyOf(&sb))
+
+	// Test: Chunk extensions, quoted when they are not tokens
+	sb.Reset()
+	w = chunkedWriter(t, &sb, "")
+	_, err = w.WriteChunk([]byte("data"), ChunkExtension{Name: "sig", Value: "a1"}, ChunkExtension{Name: "note", Value: `say "hi"`}, ChunkExtension{Name: "last"})
+	require.NoError(t, err)
+	assert.Equal(t, "4;sig=a1;note=\"say \\\"hi\\\"\";last\r\ndata\r\n", bodyOf(&sb))
+
+	for _, ext := range []ChunkExtension{{Name: ""}, {Name: "a b"}, {Name: "ok", Value: "line\r\nbreak"}} {
+		_, err = w.WriteChunk([]byte("data"), ext)
+		assert.ErrorIs(t, err, ERROR_INVALID_CHUNK_EXTENSION, ext.Name)
+	}
+}
+
+func TestChunkedWriter(t *testing.T) {
+	// Test: Small writes are coalesced, large ones go out whole
+	var sb strings.Builder
+	w := chunkedWriter(t, &sb, "")
+	cw, err := NewChunkedWriter(w, ChunkedOptions{ChunkSize: 4})
+	require.NoError(t, err)
+	var _ io.WriteCloser = cw
+
+	for _, s := range []string{"a", "", "bc", "def", "ghijklmn"} {
+		n, err := cw.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	require.NoError(t, cw.Close())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "4\r\nabcd\r\n4\r\nefgh\r\n4\r\nijkl\r\n2\r\nmn\r\n0\r\n\r\n", bodyOf(&sb))
+
+	_, err = cw.Write([]byte("late"))
+	assert.ErrorIs(t, err, ERROR_CHUNKED_WRITER_CLOSED)
+
+	// Test: Writes go out whole when nothing is pending
+	sb.Reset()
+	w = chunkedWriter(t, &sb, "")
+	cw, _ = NewChunkedWriter(w, ChunkedOptions{ChunkSize: 4})
+	cw.Write([]byte("abcdefgh"))
+	cw.Write([]byte("ij"))
+	require.NoError(t, cw.Flush())
+	assert.Equal(t, "8\r\nabcdefgh\r\n2\r\nij\r\n", bodyOf(&sb))
+
+	// Test: Flush gets the chunk past a buffered Writer
+	var out countingWriter
+	w = chunkedWriterFrom(t, NewBufferedWriter(&out), &strings.Builder{}, "")
+	cw, _ = NewChunkedWriter(w, ChunkedOptions{})
+	cw.Write([]byte("abc"))
+	require.NoError(t, cw.Flush())
+	assert.Equal(t, 1, out.writes)
+	assert.True(t, strings.HasSuffix(out.sb.String(), "\r\n\r\n3\r\nabc\r\n"), out.sb.String())
+
+	// Test: Extensions on every chunk, and on single chunks
+	sb.Reset()
+	w = chunkedWriter(t, &sb, "X-Sum")
+	cw, err = NewChunkedWriter(w, ChunkedOptions{Extensions: []ChunkExtension{{Name: "v", Value: "1"}}})
+	require.NoError(t, err)
+	cw.Write([]byte("hello "))
+	require.NoError(t, cw.WriteChunk([]byte("world"), ChunkExtension{Name: "end"}))
+	require.NoError(t, cw.Close())
+	require.NoError(t, w.WriteTrailers(trailers("X-Sum", "42")))
+	assert.Equal(t, "6;v=1\r\nhello \r\n5;v=1;end\r\nworld\r\n0\r\nx-sum: 42\r\n\r\n", bodyOf(&sb))
+
+	r, err := ResponseFromReader(strings.NewReader(sb.String()), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+
+	_, err = NewChunkedWriter(w, ChunkedOptions{Extensions: []ChunkExtension{{Name: "bad name"}}})
+	assert.ErrorIs(t, err, ERROR_INVALID_CHUNK_EXTENSION)
+}
@@ -0,0 +1,167 @@
+package response
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.serve/internal/headers"
+)
+
+// Integrity fields of RFC 9530. Content-Digest covers the bytes of this
+// message, Repr-Digest the whole representation, which only differ for
+// partial content.
+const (
+	ContentDigest = "content-digest"
+	ReprDigest    = "repr-digest"
+	// running length and hex SHA-256 of a chunked body, sent along with
+	// the digests
+	contentLengthTrailer = "x-content-length"
+	contentSHA256Trailer = "x-content-sha256"
+)
+
+var ERROR_UNSUPPORTED_DIGEST = fmt.Errorf("Unsupported digest")
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// PreferredDigest picks the algorithm a Want-Content-Digest or
+// Want-Repr-Digest value ranks highest among those we support, e.g.
+// "sha-512=3, sha-256=10" gives sha-256. A weight of 0 means not wanted.
+// It returns "" if there is none.
+func PreferredDigest(want string) string {
+	best, bestWeight := "", 0
+	for _, member := range strings.Split(want, ",") {
+		name, value, found := strings.Cut(member, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		weight := 1
+		if found {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || n < 0 || n > 10 {
+				continue
+			}
+			weight = n
+		}
+
+		if digestAlgorithms[name] != nil && weight > bestWeight {
+			best, bestWeight = name, weight
+		}
+	}
+	return best
+}
+
+// digester hashes a chunked body as it is written. SHA-256 is always
+// computed, for X-Content-SHA256, once any digest was asked for.
+type digester struct {
+	// field to the algorithm used for it
+	fields map[string]string
+	hashes map[string]hash.Hash
+	length int64
+}
+
+func newDigester() *digester {
+	return &digester{
+		fields: map[string]string{},
+		hashes: map[string]hash.Hash{"sha-256": sha256.New()},
+	}
+}
+
+func (d *digester) add(field, algorithm string) {
+	d.fields[field] = algorithm
+	if d.hashes[algorithm] == nil {
+		d.hashes[algorithm] = digestAlgorithms[algorithm]()
+	}
+}
+
+func (d *digester) Write(p []byte) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	d.length += int64(len(p))
+}
+
+// names lists the trailer fields the digester produces.
+func (d *digester) names() []string {
+	names := []string{contentLengthTrailer, contentSHA256Trailer}
+	for field := range d.fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// produces reports whether name is one of the digester's trailer fields.
+func (d *digester) produces(name string) bool {
+	return name == contentLengthTrailer || name == contentSHA256Trailer || d.fields[name] != ""
+}
+
+// addTrailers sets the digest fields the handler did not set itself.
+func (d *digester) addTrailers(h *headers.Headers) {
+	if _, ok := h.Get(contentLengthTrailer); !ok {
+		h.Set(contentLengthTrailer, strconv.FormatInt(d.length, 10))
+	}
+	if _, ok := h.Get(contentSHA256Trailer); !ok {
+		h.Set(contentSHA256Trailer, hex.EncodeToString(d.hashes["sha-256"].Sum(nil)))
+	}
+
+	for field, algorithm := range d.fields {
+		if _, ok := h.Get(field); ok {
+			continue
+		}
+		sum := base64.StdEncoding.EncodeToString(d.hashes[algorithm].Sum(nil))
+		h.Set(field, fmt.Sprintf("%s=:%s:", algorithm, sum))
+	}
+}
+
+// SetDigestTrailers sends field, ContentDigest or ReprDigest, as a trailer
+// computed with algorithm ("sha-256" or "sha-512") while the body is
+// written, along with its running length in X-Content-Length and its
+// SHA-256 in X-Content-SHA256. The server calls it for clients sending
+// Want-Content-Digest or Want-Repr-Digest, handlers may do so for any
+// response. It only takes effect on chunked responses and must be called
+// before the headers are written.
+func (w *Writer) SetDigestTrailers(field, algorithm string) error {
+	field = strings.ToLower(field)
+	if field != ContentDigest && field != ReprDigest || digestAlgorithms[algorithm] == nil {
+		return fmt.Errorf("%w: %s %s", ERROR_UNSUPPORTED_DIGEST, field, algorithm)
+	}
+	if w.writerState != stateStatus && w.writerState != stateHeaders {
+		return fmt.Errorf("Headers already written")
+	}
+
+	if w.digests == nil {
+		w.digests = newDigester()
+	}
+	w.digests.add(field, algorithm)
+	return nil
+}
+
+// declareDigests announces the digest trailers once it is known the body
+// is chunked. Partial content is not the whole representation, so it gets
+// no Repr-Digest.
+func (w *Writer) declareDigests(h *headers.Headers) {
+	if w.digests == nil {
+		return
+	}
+	if !w.chunked || w.head {
+		w.digests = nil
+		return
+	}
+
+	if w.status == StatusPartialContent {
+		delete(w.digests.fields, ReprDigest)
+	}
+	for _, name := range w.digests.names() {
+		h.Set("Trailer", name)
+		w.declared[name] = true
+	}
+}
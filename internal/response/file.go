@@ -0,0 +1,209 @@
+package response
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.serve/internal/headers"
+)
+
+var ERROR_MALFORMED_RANGE = fmt.Errorf("Malformed Range")
+var ERROR_RANGE_NOT_SATISFIABLE = fmt.Errorf("Range not satisfiable")
+var ERROR_IS_DIRECTORY = fmt.Errorf("File is a directory")
+
+// ReadFrom writes the body from src, so io.Copy into a Writer uses it. A
+// body with a Content-Length is handed to the connection as it is: on a
+// plain TCP connection a file goes out with sendfile(2) and never passes
+// through user space. Anything else, e.g. TLS connections or chunked
+// bodies, is copied through the buffer.
+func (w *Writer) ReadFrom(src io.Reader) (int64, error) {
+	if w.hijacked {
+		return 0, ERROR_HIJACKED
+	}
+
+	if w.writerState != stateBody {
+		return 0, fmt.Errorf("Must write status line and headers before the body")
+	}
+
+	if w.head {
+		w.writerState = stateDone
+		return 0, nil
+	}
+
+	if w.chunked || w.closeDelimited {
+		return w.copyChunks(src)
+	}
+
+	if w.contentLength >= 0 {
+		src = io.LimitReader(src, w.contentLength-w.written)
+	}
+
+	// What the handler wrote before has to go out first
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w.dst, src)
+	w.written += n
+	if err != nil {
+		return n, err
+	}
+
+	if w.contentLength < 0 || w.written >= w.contentLength {
+		w.writerState = stateDone
+	}
+	return n, nil
+}
+
+// copyChunks sends src as one chunk per read.
+func (w *Writer) copyChunks(src io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	written := int64(0)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// parseRange reads a single byte range (RFC 9110 section 14.1.2) of a
+// representation size bytes long, returning where it starts and its
+// length. Ranges past the end are ERROR_RANGE_NOT_SATISFIABLE. Several
+// ranges would need a multipart body, so they are ERROR_MALFORMED_RANGE
+// and get the whole file like any other Range we can't use.
+func parseRange(value string, size int64) (int64, int64, error) {
+	unit, spec, ok := strings.Cut(value, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") || strings.Contains(spec, ",") {
+		return 0, 0, ERROR_MALFORMED_RANGE
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, ERROR_MALFORMED_RANGE
+	}
+
+	parse := func(s string) (int64, error) {
+		if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+			return 0, ERROR_MALFORMED_RANGE
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, ERROR_MALFORMED_RANGE
+		}
+		return n, nil
+	}
+
+	// "-500" is the last 500 bytes
+	if first == "" {
+		n, err := parse(last)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, ERROR_RANGE_NOT_SATISFIABLE
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err := parse(first)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = parse(last)
+		if err != nil {
+			return 0, 0, err
+		}
+		if end < start {
+			return 0, 0, ERROR_MALFORMED_RANGE
+		}
+		end = min(end, size-1)
+	}
+
+	if start >= size {
+		return 0, 0, ERROR_RANGE_NOT_SATISFIABLE
+	}
+	return start, end - start + 1, nil
+}
+
+// WriteFile sends f as the whole response, with h as the headers and its
+// size as the Content-Length. rangeHeader is the request's Range field,
+// empty if there is none: a single byte range is answered with 206 and
+// only that part, one past the end with 416. The body goes out through
+// ReadFrom, so it is not read into memory.
+func (w *Writer) WriteFile(f *os.File, h headers.Headers, rangeHeader string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return ERROR_IS_DIRECTORY
+	}
+
+	size := info.Size()
+	start, length := int64(0), size
+	status := StatusOK
+
+	h.Delete("Transfer-Encoding")
+	h.Replace("Accept-Ranges", "bytes")
+
+	if rangeHeader != "" {
+		first, n, err := parseRange(rangeHeader, size)
+		switch err {
+		case nil:
+			start, length = first, n
+			status = StatusPartialContent
+			h.Replace("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		case ERROR_RANGE_NOT_SATISFIABLE:
+			h.Replace("Content-Range", fmt.Sprintf("bytes */%d", size))
+			h.Replace("Content-Length", "0")
+			if err := w.WriteStatusLine(StatusRangeNotSatisfiable); err != nil {
+				return err
+			}
+			return w.WriteHeaders(h)
+		}
+	}
+
+	h.Replace("Content-Length", strconv.FormatInt(length, 10))
+	if err := w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	if w.head {
+		_, err := w.ReadFrom(f)
+		return err
+	}
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := w.ReadFrom(f)
+	if err != nil {
+		return err
+	}
+	// The file shrank since we looked at its size
+	if n < length {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package response
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempFile(t *testing.T, content string) *os.File {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseRange(t *testing.T) {
+	for value, want := range map[string][2]int64{
+		"bytes=0-4":    {0, 5},
+		"bytes=5-":     {5, 5},
+		"bytes=-3":     {7, 3},
+		"bytes=-100":   {0, 10},
+		"bytes=8-100":  {8, 2},
+		"Bytes = 2-2 ": {2, 1},
+	} {
+		start, length, err := parseRange(value, 10)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, [2]int64{start, length}, value)
+	}
+
+	for value, want := range map[string]error{
+		"bytes=10-":     ERROR_RANGE_NOT_SATISFIABLE,
+		"bytes=-0":      ERROR_RANGE_NOT_SATISFIABLE,
+		"bytes=5-2":     ERROR_MALFORMED_RANGE,
+		"bytes=0-1,3-4": ERROR_MALFORMED_RANGE,
+		"items=0-1":     ERROR_MALFORMED_RANGE,
+		"bytes=a-b":     ERROR_MALFORMED_RANGE,
+		"bytes=-":       ERROR_MALFORMED_RANGE,
+		"bytes=+1-2":    ERROR_MALFORMED_RANGE,
+	} {
+		_, _, err := parseRange(value, 10)
+		assert.ErrorIs(t, err, want, value)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	f := tempFile(t, "0123456789")
+	send := func(rangeHeader string, head bool) *Response {
+		var sb strings.Builder
+		w := NewBufferedWriter(&sb)
+		w.SetHead(head)
+		require.NoError(t, w.WriteFile(f, GetDefaultHeaders(0), rangeHeader))
+		require.NoError(t, w.Release())
+
+		method := "GET"
+		if head {
+			method = "HEAD"
+		}
+		r, err := ResponseFromReader(strings.NewReader(sb.String()), method)
+		require.NoError(t, err)
+		return r
+	}
+
+	// Test: The whole file
+	r := send("", false)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "0123456789", string(r.Body))
+	ranges, _ := r.Headers.Get("accept-ranges")
+	assert.Equal(t, "bytes", ranges)
+
+	// Test: A single range
+	r = send("bytes=2-5", false)
+	assert.Equal(t, StatusPartialContent, r.StatusLine.StatusCode)
+	assert.Equal(t, "2345", string(r.Body))
+	contentRange, _ := r.Headers.Get("content-range")
+	assert.Equal(t, "bytes 2-5/10", contentRange)
+
+	r = send("bytes=-2", false)
+	assert.Equal(t, "89", string(r.Body))
+
+	// Test: Past the end
+	r = send("bytes=20-", false)
+	assert.Equal(t, StatusRangeNotSatisfiable, r.StatusLine.StatusCode)
+	assert.Empty(t, r.Body)
+	contentRange, _ = r.Headers.Get("content-range")
+	assert.Equal(t, "bytes */10", contentRange)
+
+	// Test: Ranges we can't use get the whole file
+	r = send("bytes=0-1,4-5", false)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "0123456789", string(r.Body))
+
+	// Test: HEAD gets the headers only
+	r = send("bytes=0-3", true)
+	assert.Equal(t, StatusPartialContent, r.StatusLine.StatusCode)
+	length, _ := r.Headers.Get("content-length")
+	assert.Equal(t, "4", length)
+
+	// Test: Directories can't be sent
+	dir, err := os.Open(t.TempDir())
+	require.NoError(t, err)
+	defer dir.Close()
+	assert.ErrorIs(t, NewWriter(&strings.Builder{}).WriteFile(dir, GetDefaultHeaders(0), ""), ERROR_IS_DIRECTORY)
+}
+
+func TestReadFrom(t *testing.T) {
+	// Test: Nothing past the Content-Length is sent
+	var sb strings.Builder
+	w := NewWriter(&sb)
+	w.SetKeepAlive(true)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(5))
+	n, err := w.ReadFrom(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.True(t, strings.HasSuffix(sb.String(), "\r\n\r\nhello"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked bodies are chunked
+	sb.Reset()
+	w = chunkedWriter(t, &sb, "")
+	n, err = w.ReadFrom(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	w.WriteChunkedBodyDone()
+	w.Finish()
+	assert.True(t, strings.HasSuffix(sb.String(), "\r\n\r\nb\r\nhello world\r\n0\r\n\r\n"), sb.String())
+}
@@ -0,0 +1,441 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go.serve/internal/chunked"
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+)
+
+// Responses with a larger status line and header section are rejected
+const maxHeadSize = 64 << 10
+
+var ERROR_MALFORMED_STATUS_LINE = fmt.Errorf("Malformed status line")
+var ERROR_INVALID_CONTENT_LENGTH = fmt.Errorf("Invalid Content-Length")
+var ERROR_HEADERS_TOO_LARGE = fmt.Errorf("Response header section too large")
+var RESPONSE_IN_ERROR_STATE = fmt.Errorf("Response in error state")
+
+var SEPARATOR = []byte("\r\n")
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type parserState int
+
+const (
+	StateInit    parserState = 0
+	StateHeaders parserState = 1
+	StateBody    parserState = 2
+	StateDone    parserState = 3
+	StateError   parserState = 4
+)
+
+// Response is a response read from an upstream server, the counterpart of
+// request.Request.
+type Response struct {
+	StatusLine StatusLine
+	State      parserState
+	Headers    headers.Headers
+	// Body holds the response body once it has been read with ReadBody.
+	// ResponseFromReader reads it eagerly.
+	Body []byte
+	// Trailers sent after a chunked body, filled in once it is read
+	Trailers headers.Headers
+
+	// method of the request answered, as HEAD changes the framing
+	method        string
+	chunked       bool
+	untilClose    bool
+	contentLength int64
+	body          *body
+}
+
+func newResponse(method string) *Response {
+	return &Response{
+		State:    StateInit,
+		Headers:  *headers.NewHeaders(),
+		Trailers: *headers.NewHeaders(),
+		method:   method,
+	}
+}
+
+func parseStatusLine(b []byte) (*StatusLine, int, error) {
+	idx := bytes.Index(b, SEPARATOR)
+	if idx == -1 {
+		return nil, 0, nil
+	}
+
+	statusLine := b[:idx]
+	read := idx + len(SEPARATOR)
+
+	// The reason phrase may contain spaces or be missing altogether
+	parts := bytes.SplitN(statusLine, []byte(" "), 3)
+	if len(parts) < 2 {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+
+	version, ok := bytes.CutPrefix(parts[0], []byte("HTTP/"))
+	if !ok || len(version) != 3 || version[0] != '1' || version[1] != '.' ||
+		version[2] < '0' || version[2] > '9' {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+
+	code := parts[1]
+	if len(code) != 3 || strings.Trim(string(code), "0123456789") != "" || code[0] == '0' {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+	status, _ := strconv.Atoi(string(code))
+
+	sl := &StatusLine{
+		HttpVersion: string(version),
+		StatusCode:  StatusCode(status),
+	}
+	if len(parts) == 3 {
+		sl.ReasonPhrase = string(bytes.TrimSpace(parts[2]))
+	}
+
+	return sl, read, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+
+	read := 0
+outer:
+	for {
+		currentData := data[read:]
+		if len(currentData) == 0 {
+			break outer
+		}
+		switch r.State {
+		case StateError:
+			return 0, RESPONSE_IN_ERROR_STATE
+		case StateInit:
+			sl, n, err := parseStatusLine(currentData)
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			r.StatusLine = *sl
+			read += n
+
+			r.State = StateHeaders
+		case StateHeaders:
+			n, done, err := r.Headers.Parse(currentData)
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				break outer
+			}
+
+			read += n
+
+			if done {
+				if err := r.parseFraming(); err != nil {
+					return 0, err
+				}
+
+				if r.HasBody() {
+					r.State = StateBody
+				} else {
+					r.State = StateDone
+				}
+			}
+
+		case StateBody:
+			// The body is streamed by BodyReader, not parsed here
+			break outer
+
+		case StateDone:
+			break outer
+		default:
+			panic("Something went wrong...")
+		}
+	}
+	return read, nil
+}
+
+// Bodiless reports whether the response has no body whatever its headers
+// say: replies to HEAD, 1xx, 204 and 304, and a successful CONNECT whose
+// connection has become a tunnel (RFC 9112 section 6.3).
+func (r *Response) Bodiless() bool {
+	status := r.StatusLine.StatusCode
+	return r.method == request.MethodHead ||
+		status < 200 ||
+		status == StatusNoContent ||
+		status == StatusNotModified ||
+		r.method == request.MethodConnect && status < 300
+}
+
+// parseFraming decides how the body is delimited (RFC 9112 section 6.3).
+func (r *Response) parseFraming() error {
+	r.contentLength = 0
+
+	if r.Bodiless() {
+		return nil
+	}
+
+	// Transfer-Encoding overrides Content-Length. Without chunked last the
+	// body runs until the connection closes.
+	if te := r.Headers.Values("transfer-encoding"); len(te) > 0 {
+		codings := strings.Split(strings.Join(te, ","), ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.chunked = true
+		} else {
+			r.untilClose = true
+		}
+		r.contentLength = -1
+		return nil
+	}
+
+	values := r.Headers.Values("content-length")
+	if len(values) == 0 {
+		r.untilClose = true
+		r.contentLength = -1
+		return nil
+	}
+
+	// A list of identical values is allowed, e.g. "42, 42"
+	length := int64(-1)
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+				return ERROR_INVALID_CONTENT_LENGTH
+			}
+
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || length != -1 && n != length {
+				return ERROR_INVALID_CONTENT_LENGTH
+			}
+			length = n
+		}
+	}
+
+	r.contentLength = length
+	return nil
+}
+
+func (r *Response) HasBody() bool {
+	return r.contentLength != 0
+}
+
+// ContentLength is the length of the body that follows: 0 if there is
+// none and -1 if it is chunked or runs until the connection closes.
+func (r *Response) ContentLength() int64 {
+	return r.contentLength
+}
+
+// Informational reports whether this is an interim 1xx response that a
+// final one follows. 101 ends the exchange as the protocol changes.
+func (r *Response) Informational() bool {
+	status := r.StatusLine.StatusCode
+	return status >= 100 && status < 200 && status != StatusSwitchingProtocols
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// the body has been read.
+func (r *Response) KeepAlive() bool {
+	if r.untilClose || r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.StatusLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+func (r *Response) headDone() bool {
+	return r.State == StateBody || r.State == StateDone || r.State == StateError
+}
+
+// readHead parses one status line and header section from br, leaving the
+// body unread in the buffer. Only a single line has to fit in br.
+func readHead(br *bufio.Reader, method string) (*Response, error) {
+	response := newResponse(method)
+	size := 0
+
+	for !response.headDone() {
+		data, err := br.Peek(br.Buffered())
+		if err != nil {
+			return nil, err
+		}
+
+		readN, err := response.parse(data)
+		if err != nil {
+			return nil, err
+		}
+		br.Discard(readN)
+
+		size += readN
+		if size > maxHeadSize {
+			return nil, ERROR_HEADERS_TOO_LARGE
+		}
+
+		if response.headDone() {
+			break
+		}
+
+		// Wait for at least one more byte than we already have
+		_, err = br.Peek(br.Buffered() + 1)
+		if err == bufio.ErrBufferFull {
+			return nil, ERROR_HEADERS_TOO_LARGE
+		}
+		if err == io.EOF && (response.State != StateInit || br.Buffered() > 0) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response.body = newBody(response, br)
+	return response, nil
+}
+
+// ReadResponse reads the final response to a request made with method,
+// skipping interim 1xx responses. The body is read from br on demand
+// through BodyReader or ReadBody.
+func ReadResponse(br *bufio.Reader, method string) (*Response, error) {
+	for {
+		response, err := readHead(br, method)
+		if err != nil {
+			return nil, err
+		}
+
+		if !response.Informational() {
+			return response, nil
+		}
+	}
+}
+
+// ResponseFromReader parses a whole response, including its body.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	response, err := ReadResponse(bufio.NewReader(reader), method)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := response.ReadBody(); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// lengthReader reads exactly remaining bytes from src
+type lengthReader struct {
+	src       *bufio.Reader
+	remaining int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+
+	n, err := l.src.Read(p)
+	l.remaining -= int64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// body streams the response body out of the connection buffer.
+type body struct {
+	resp *Response
+	src  io.Reader
+	err  error
+	all  []byte
+}
+
+func newBody(resp *Response, src *bufio.Reader) *body {
+	b := &body{resp: resp}
+
+	switch {
+	case resp.chunked:
+		b.src = chunked.NewReader(src, &resp.Trailers)
+	case resp.untilClose:
+		b.src = src
+	default:
+		b.src = &lengthReader{
+			src:       src,
+			remaining: max(resp.contentLength, 0),
+		}
+	}
+
+	return b
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if !b.resp.HasBody() {
+		return 0, io.EOF
+	}
+
+	n, err := b.src.Read(p)
+	if err == io.EOF {
+		b.err = err
+		b.resp.State = StateDone
+	} else if err != nil {
+		b.err = err
+		b.resp.State = StateError
+	}
+
+	return n, err
+}
+
+// BodyReader returns the response body as a stream. Once ReadBody has been
+// called it reads from the buffered copy instead.
+func (r *Response) BodyReader() io.Reader {
+	if r.body == nil {
+		return bytes.NewReader(r.Body)
+	}
+
+	if r.body.all != nil {
+		return bytes.NewReader(r.body.all)
+	}
+
+	return r.body
+}
+
+// ReadBody reads the rest of the body into Body and returns it.
+func (r *Response) ReadBody() ([]byte, error) {
+	if r.body == nil {
+		return r.Body, nil
+	}
+
+	if r.body.all == nil {
+		all, err := io.ReadAll(r.body)
+		if err != nil {
+			return nil, err
+		}
+		r.body.all = all
+	}
+
+	r.Body = r.body.all
+	return r.Body, nil
+}
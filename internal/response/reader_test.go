@@ -0,0 +1,174 @@
+package response
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+
+	endIndex := cr.pos + cr.numBytesPerRead
+	if endIndex > len(cr.data) {
+		endIndex = len(cr.data)
+	}
+
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+
+	return n, nil
+}
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Read a byte at a time
+	r, err := ResponseFromReader(&chunkReader{
+		data:            "HTTP/1.1 404 Not Found\r\nContent-Length: 4\r\nX-Thing: a\r\n\r\ngone",
+		numBytesPerRead: 1,
+	}, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusNotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+	thing, _ := r.Headers.Get("x-thing")
+	assert.Equal(t, "a", thing)
+	assert.Equal(t, "gone", string(r.Body))
+	assert.Equal(t, StateDone, r.State)
+
+	// Test: The reason phrase is optional
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200\r\nContent-Length: 0\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Malformed status lines
+	for _, line := range []string{
+		"HTTP/1.1\r\n",
+		"HTTP/2 200 OK\r\n",
+		"HTTP/1.1 20 OK\r\n",
+		"HTTP/1.1 2x0 OK\r\n",
+		"HTTP/1.1 099 OK\r\n",
+		"http/1.1 200 OK\r\n",
+		"ICY 200 OK\r\n",
+	} {
+		_, err = ResponseFromReader(strings.NewReader(line+"\r\n"), "GET")
+		assert.ErrorIs(t, err, ERROR_MALFORMED_STATUS_LINE, line)
+	}
+}
+
+func TestResponseBodies(t *testing.T) {
+	// Test: Chunked with trailers
+	r, err := ResponseFromReader(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 42\r\n\r\n",
+		numBytesPerRead: 3,
+	}, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength())
+	assert.Equal(t, "hello world", string(r.Body))
+	sum, _ := r.Trailers.Get("x-sum")
+	assert.Equal(t, "42", sum)
+	assert.True(t, r.KeepAlive())
+
+	// Test: No length reads until the connection closes
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\nall of it"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "all of it", string(r.Body))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Transfer-Encoding wins over Content-Length
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+
+	// Test: Bodies cut short
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"), "GET")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n"), "GET")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Conflicting lengths
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 1, 2\r\n\r\nx"), "GET")
+	assert.ErrorIs(t, err, ERROR_INVALID_CONTENT_LENGTH)
+}
+
+func TestBodilessResponses(t *testing.T) {
+	next := "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nnext"
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		head   string
+	}{
+		{"HEAD", "HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\n"},
+		{"204", "GET", "HTTP/1.1 204 No Content\r\n\r\n"},
+		{"304", "GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 12\r\n\r\n"},
+		{"CONNECT", "CONNECT", "HTTP/1.1 200 Connection Established\r\n\r\n"},
+		{"101", "GET", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"},
+	} {
+		// Test: Nothing is read past the head, so what follows stays on
+		// the connection
+		br := bufio.NewReader(strings.NewReader(tc.head + next))
+		r, err := ReadResponse(br, tc.method)
+		require.NoError(t, err, tc.name)
+		assert.True(t, r.Bodiless(), tc.name)
+		assert.Equal(t, int64(0), r.ContentLength(), tc.name)
+		body, err := r.ReadBody()
+		require.NoError(t, err, tc.name)
+		assert.Empty(t, body, tc.name)
+
+		r, err = ReadResponse(br, "GET")
+		require.NoError(t, err, tc.name)
+		body, err = r.ReadBody()
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, "next", string(body), tc.name)
+	}
+
+	// Test: Interim responses are skipped
+	r, err := ResponseFromReader(strings.NewReader("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n"+next), "POST")
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "next", string(r.Body))
+	_, ok := r.Headers.Get("link")
+	assert.False(t, ok)
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	// Test: What the writer produces parses back
+	var sb strings.Builder
+	w := NewWriter(&sb)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Done")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("streamed"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	tr := headers.NewHeaders()
+	tr.Set("X-Done", "yes")
+	require.NoError(t, w.WriteTrailers(*tr))
+
+	r, err := ResponseFromReader(strings.NewReader(sb.String()), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "streamed", string(r.Body))
+	done, _ := r.Trailers.Get("x-done")
+	assert.Equal(t, "yes", done)
+}
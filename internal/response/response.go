@@ -1,32 +1,95 @@
 package response
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 
+	"go.serve/internal/cookie"
 	"go.serve/internal/headers"
 )
 
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusContinue                StatusCode = 100
+	StatusSwitchingProtocols      StatusCode = 101
+	StatusOK                      StatusCode = 200
+	StatusNoContent               StatusCode = 204
+	StatusPartialContent          StatusCode = 206
+	StatusMovedPermanently        StatusCode = 301
+	StatusFound                   StatusCode = 302
+	StatusSeeOther                StatusCode = 303
+	StatusNotModified             StatusCode = 304
+	StatusTemporaryRedirect       StatusCode = 307
+	StatusPermanentRedirect       StatusCode = 308
+	StatusBadRequest              StatusCode = 400
+	StatusForbidden               StatusCode = 403
+	StatusNotFound                StatusCode = 404
+	StatusMethodNotAllowed        StatusCode = 405
+	StatusContentTooLarge         StatusCode = 413
+	StatusRangeNotSatisfiable     StatusCode = 416
+	StatusExpectationFailed       StatusCode = 417
+	StatusUpgradeRequired         StatusCode = 426
+	StatusHeaderFieldsTooLarge    StatusCode = 431
+	StatusInternalServerError     StatusCode = 500
+	StatusNotImplemented          StatusCode = 501
+	StatusBadGateway              StatusCode = 502
+	StatusServiceUnavailable      StatusCode = 503
+	StatusGatewayTimeout          StatusCode = 504
+	StatusHTTPVersionNotSupported StatusCode = 505
 )
 
 var statusName = map[StatusCode]string{
-	StatusOK:                  "OK",
-	StatusBadRequest:          "Bad Request",
-	StatusInternalServerError: "Internal Server Error",
+	StatusContinue:                "Continue",
+	StatusSwitchingProtocols:      "Switching Protocols",
+	StatusOK:                      "OK",
+	StatusNoContent:               "No Content",
+	StatusPartialContent:          "Partial Content",
+	StatusMovedPermanently:        "Moved Permanently",
+	StatusFound:                   "Found",
+	StatusSeeOther:                "See Other",
+	StatusNotModified:             "Not Modified",
+	StatusTemporaryRedirect:       "Temporary Redirect",
+	StatusPermanentRedirect:       "Permanent Redirect",
+	StatusBadRequest:              "Bad Request",
+	StatusForbidden:               "Forbidden",
+	StatusNotFound:                "Not Found",
+	StatusMethodNotAllowed:        "Method Not Allowed",
+	StatusContentTooLarge:         "Content Too Large",
+	StatusRangeNotSatisfiable:     "Range Not Satisfiable",
+	StatusExpectationFailed:       "Expectation Failed",
+	StatusUpgradeRequired:         "Upgrade Required",
+	StatusHeaderFieldsTooLarge:    "Request Header Fields Too Large",
+	StatusInternalServerError:     "Internal Server Error",
+	StatusNotImplemented:          "Not Implemented",
+	StatusBadGateway:              "Bad Gateway",
+	StatusServiceUnavailable:      "Service Unavailable",
+	StatusGatewayTimeout:          "Gateway Timeout",
+	StatusHTTPVersionNotSupported: "HTTP Version Not Supported",
 }
 
 func (sc StatusCode) String() string {
 	return statusName[sc]
 }
 
+// statusLines holds the status line of every code we know, so writing one
+// costs nothing
+var statusLines = func() map[StatusCode]string {
+	lines := make(map[StatusCode]string, len(statusName))
+	for code := range statusName {
+		lines[code] = formatStatusLine(code)
+	}
+	return lines
+}()
+
+func formatStatusLine(sc StatusCode) string {
+	return "HTTP/1.1 " + strconv.Itoa(int(sc)) + " " + sc.String() + " \r\n"
+}
+
 type responseState int
 
 const (
@@ -40,48 +103,282 @@ const (
 type Writer struct {
 	writerState responseState
 	writer      io.Writer
+	// set by NewBufferedWriter, writer then points at it
+	buffer *bufio.Writer
+	// what is below the buffer, which ReadFrom hands bodies to directly
+	dst           io.Writer
+	beforeHeaders []func(h *headers.Headers) error
+	beforeFinish  []func() error
+
+	// What the connection needs to know once the response is done
+	keepAlive bool
+	http10    bool
+	// HEAD responses carry the headers of a GET but no body
+	head    bool
+	status  StatusCode
+	chunked bool
+	// HTTP/1.0 clients get chunked responses as a body ended by closing
+	// the connection
+	closeDelimited bool
+	contentLength  int64
+	written        int64
+	// trailer fields announced in the Trailer header
+	declared map[string]bool
+	digests  *digester
+
+	// hijack hands the connection to the handler, set by the server
+	hijack   func() (net.Conn, []byte, error)
+	hijacked bool
 }
 
-// do we pass the connection to write here?
-func NewWriter(conn net.Conn) *Writer {
+func NewWriter(writer io.Writer) *Writer {
 	return &Writer{
-		writerState: stateStatus,
-		writer:      conn,
+		writerState:   stateStatus,
+		writer:        writer,
+		dst:           writer,
+		contentLength: -1,
+	}
+}
+
+// SetKeepAlive tells the writer whether the connection may be reused after
+// this response. When it may not, Connection: close is added to the headers.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetHTTP10 marks the request as HTTP/1.0. Such clients can't decode
+// chunked bodies, and only keep the connection open when told explicitly.
+func (w *Writer) SetHTTP10(http10 bool) {
+	w.http10 = http10
+}
+
+var ERROR_HIJACK_NOT_SUPPORTED = fmt.Errorf("Connection can not be hijacked")
+var ERROR_HIJACKED = fmt.Errorf("Connection has been hijacked")
+
+// SetHijacker lets the server provide the connection to Hijack.
+func (w *Writer) SetHijacker(hijack func() (net.Conn, []byte, error)) {
+	w.hijack = hijack
+}
+
+// Hijack takes over the connection, e.g. to switch protocols or tunnel
+// CONNECT. It waits until the responses to earlier pipelined requests have
+// been sent, and returns the connection with any bytes the server already
+// read past the request. Whatever was written to the Writer is sent first.
+// From then on the server leaves the connection alone: the caller writes
+// everything else and closes it, and the Writer can no longer be used.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ERROR_HIJACKED
+	}
+	if w.hijack == nil {
+		return nil, nil, ERROR_HIJACK_NOT_SUPPORTED
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	conn, buffered, err := w.hijack()
+	if err != nil {
+		return nil, nil, err
 	}
+
+	w.hijacked = true
+	w.Release()
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether the handler took over the connection.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// Started reports whether the status line has been written.
+func (w *Writer) Started() bool {
+	return w.writerState != stateStatus
+}
+
+// SetHead marks the response as an answer to HEAD. The handler can write
+// it exactly like a GET response; the body is dropped and only the status
+// and headers are sent.
+func (w *Writer) SetHead(head bool) {
+	w.head = head
+}
+
+// KeepAlive reports whether the connection can carry another response:
+// keep-alive was allowed, the handler did not ask to close, and the
+// response was completely framed.
+func (w *Writer) KeepAlive() bool {
+	if w.hijacked || !w.keepAlive || w.writerState < stateBody {
+		return false
+	}
+
+	if w.head || w.status == StatusNoContent || w.status == StatusNotModified {
+		return true
+	}
+
+	if w.chunked {
+		return w.writerState == stateDone
+	}
+
+	return w.contentLength >= 0 && w.written == w.contentLength
 }
 
+// WriteStatusLine sets the status. The line goes out with the headers, so
+// that a hook failing in WriteHeaders can still turn it into a 500.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.hijacked {
+		return ERROR_HIJACKED
+	}
+
+	if _, released := w.writer.(releasedWriter); released {
+		return ERROR_WRITER_RELEASED
+	}
 	if w.writerState != stateStatus {
 		return fmt.Errorf("Status line already written")
 	}
-	status := string(fmt.Sprintf("HTTP/1.1 %d %s \r\n", statusCode, statusCode))
-	_, err := w.writer.Write([]byte(status))
+
+	w.status = statusCode
+	w.writerState = stateHeaders
+	return nil
+}
+
+// BeforeHeaders registers fn to run just before the headers are written,
+// letting middleware add fields the handler does not know about.
+func (w *Writer) BeforeHeaders(fn func(h *headers.Headers) error) {
+	w.beforeHeaders = append(w.beforeHeaders, fn)
+}
+
+// BeforeFinish registers fn to run once the handler is done, before Finish
+// or Release touch the response. Anything that writes from another
+// goroutine, e.g. a heartbeat, has to stop in fn: afterwards the buffer
+// goes back to the pool and may belong to another connection.
+func (w *Writer) BeforeFinish(fn func() error) {
+	w.beforeFinish = append(w.beforeFinish, fn)
+}
+
+// runBeforeFinish runs the BeforeFinish functions, once.
+func (w *Writer) runBeforeFinish() error {
+	var err error
+	for _, fn := range w.beforeFinish {
+		if fnErr := fn(); fnErr != nil && err == nil {
+			err = fnErr
+		}
+	}
+	w.beforeFinish = nil
+	return err
+}
+
+// WriteContinue sends the interim 100 Continue response. It does nothing
+// once the final status line has been written.
+func (w *Writer) WriteContinue() error {
+	if w.hijacked {
+		return ERROR_HIJACKED
+	}
+
+	if w.writerState != stateStatus {
+		return nil
+	}
+
+	_, err := w.writeString("HTTP/1.1 100 Continue\r\n\r\n")
 	if err != nil {
 		return err
 	}
 
-	w.writerState = stateHeaders
-	return nil
+	// The client is waiting for it before it sends the body
+	return w.Flush()
 }
 
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 
 	h.Set("Content-Length", strconv.Itoa(contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-type", "text/plain")
 	return *h
 }
 
-func GetDefaultTrailers() headers.Headers {
-	h := headers.NewHeaders()
+// SetCookie adds a Set-Cookie field for c, rejecting invalid cookies.
+func SetCookie(h *headers.Headers, c *cookie.Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
 
-	h.Set("X-Content-SHA256", "")
-	h.Set("X-Content-Length", "")
-	return *h
+	h.Set("Set-Cookie", c.String())
+	return nil
+}
+
+func (w *Writer) writeFieldLines(h headers.Headers) error {
+	return h.Lines(func(name, value string) error {
+		_, err := w.writeString(name, ": ", value, "\r\n")
+		return err
+	})
+}
+
+var ERROR_TRAILERS_NOT_CHUNKED = fmt.Errorf("Trailers require a chunked body")
+var ERROR_TRAILERS_TOO_EARLY = fmt.Errorf("Trailers must follow WriteChunkedBodyDone")
+var ERROR_TRAILER_NOT_DECLARED = fmt.Errorf("Trailer field not declared in the Trailer header")
+var ERROR_TRAILER_FORBIDDEN = fmt.Errorf("Field not allowed in trailers")
+
+// Fields a recipient needs before the body, so they can't be sent after it
+// (RFC 9110 section 6.5.1): framing, routing, request modifiers,
+// authentication, response control and content metadata.
+var forbiddenTrailers = map[string]bool{
+	"transfer-encoding":   true,
+	"content-length":      true,
+	"trailer":             true,
+	"host":                true,
+	"cache-control":       true,
+	"expect":              true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"range":               true,
+	"te":                  true,
+	"authorization":       true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"www-authenticate":    true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"age":                 true,
+	"date":                true,
+	"expires":             true,
+	"location":            true,
+	"retry-after":         true,
+	"vary":                true,
+	"warning":             true,
+	"content-encoding":    true,
+	"content-type":        true,
+	"content-range":       true,
+}
+
+// TrailerAllowed reports whether name may be sent as a trailer field.
+func TrailerAllowed(name string) bool {
+	return !forbiddenTrailers[strings.ToLower(name)]
+}
+
+// declaredTrailers collects the names listed in the Trailer header.
+func declaredTrailers(h headers.Headers) (map[string]bool, error) {
+	declared := map[string]bool{}
+	for _, value := range h.Values("trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if !TrailerAllowed(name) {
+				return nil, fmt.Errorf("%w: %s", ERROR_TRAILER_FORBIDDEN, name)
+			}
+			declared[name] = true
+		}
+	}
+	return declared, nil
 }
 
 func (w *Writer) WriteHeaders(h headers.Headers) error {
+	if w.hijacked {
+		return ERROR_HIJACKED
+	}
+
 	if w.writerState != stateHeaders {
 		if w.writerState == stateStatus {
 			return fmt.Errorf("Missing Status Line")
@@ -89,16 +386,63 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 		return fmt.Errorf("Headers already written")
 	}
 
-	headers := h.GetAll()
-
-	for k, v := range headers {
-		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
-		if err != nil {
+	// The hooks and the framing below change the fields, which h shares
+	// with the caller's value
+	h = *h.Clone()
+	for _, fn := range w.beforeHeaders {
+		if err := fn(&h); err != nil {
+			w.failHeaders()
 			return err
 		}
 	}
 
-	_, err := w.writer.Write([]byte("\r\n"))
+	declared, err := declaredTrailers(h)
+	if err != nil {
+		return err
+	}
+	w.declared = declared
+
+	w.chunked = h.HasToken("transfer-encoding", "chunked")
+	if w.chunked && w.http10 {
+		h.Delete("Transfer-Encoding")
+		h.Delete("Trailer")
+		w.chunked = false
+		if !w.head {
+			w.closeDelimited = true
+			w.keepAlive = false
+		}
+	}
+
+	w.declareDigests(&h)
+
+	if !w.keepAlive {
+		h.Replace("Connection", "close")
+	} else if h.HasToken("connection", "close") {
+		w.keepAlive = false
+	} else if w.http10 {
+		h.Replace("Connection", "keep-alive")
+	}
+	if length, ok := h.Get("content-length"); ok && !w.chunked {
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err == nil {
+			w.contentLength = n
+		}
+	}
+
+	status, ok := statusLines[w.status]
+	if !ok {
+		status = formatStatusLine(w.status)
+	}
+	if _, err := w.writeString(status); err != nil {
+		return err
+	}
+
+	err = w.writeFieldLines(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.writeString("\r\n")
 	if err != nil {
 		return err
 	}
@@ -106,62 +450,223 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 	return nil
 }
 
+// failHeaders answers with an empty 500 in place of the response whose
+// headers a hook refused, and leaves the writer done so that the handler
+// can't add a body to it.
+func (w *Writer) failHeaders() {
+	w.beforeHeaders = nil
+	w.status = StatusInternalServerError
+	w.WriteHeaders(GetDefaultHeaders(0))
+	w.writerState = stateDone
+}
+
+// WriteBody writes the body. With a Content-Length it may be called again
+// to stream the body, until that many bytes have been written.
 func (w *Writer) WriteBody(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, ERROR_HIJACKED
+	}
+
 	if w.writerState != stateBody {
 		return 0, fmt.Errorf("Must write status line and headers before the body")
 	}
-	bytes, err := w.writer.Write(b)
-	if err != nil {
-		return 0, err
+
+	bytes := len(b)
+	if !w.head {
+		var err error
+		bytes, err = w.writer.Write(b)
+		w.written += int64(bytes)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		w.written += int64(bytes)
 	}
 
-	w.writerState = stateDone
+	if w.contentLength < 0 || w.written >= w.contentLength {
+		w.writerState = stateDone
+	}
 	return bytes, nil
 }
 
-// This works like write body except it doesn't change the writer state
+// WriteChunkedBody sends b as one chunk. It works like WriteBody except it
+// doesn't change the writer state, so it can be called again until
+// WriteChunkedBodyDone. An empty b writes nothing, since a zero-size chunk
+// would end the body.
 func (w *Writer) WriteChunkedBody(b []byte) (int, error) {
+	return w.WriteChunk(b)
+}
+
+// WriteChunk is WriteChunkedBody with chunk extensions (RFC 9112 section
+// 7.1.1) added to the size line. Recipients ignore extensions they don't
+// understand.
+func (w *Writer) WriteChunk(b []byte, ext ...ChunkExtension) (int, error) {
+	if w.hijacked {
+		return 0, ERROR_HIJACKED
+	}
+
 	if w.writerState != stateBody {
 		return 0, fmt.Errorf("Must write status line and headers before the body")
 	}
-	n, lErr := w.writer.Write([]byte(fmt.Sprintf("%x\r\n", len(b))))
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if w.head {
+		return len(b), nil
+	}
+
+	if w.closeDelimited {
+		return w.writer.Write(b)
+	}
+
+	extensions, err := formatExtensions(ext)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.digests != nil {
+		w.digests.Write(b)
+	}
+
+	// b is written as it is, never appended to, as the caller owns it
+	n, lErr := w.writeChunkSize(len(b), extensions)
 	if lErr != nil {
 		return 0, fmt.Errorf("Failed to write chunk length to body")
 	}
 
-	bytes, dErr := w.writer.Write(append(b, []byte("\r\n")...))
+	bytes, dErr := w.writer.Write(b)
 	if dErr != nil {
 		return n, fmt.Errorf("Failed to write chunked data to body")
 	}
 
-	return n + bytes, nil
+	end, eErr := w.writeString("\r\n")
+	if eErr != nil {
+		return n + bytes, fmt.Errorf("Failed to write chunked data to body")
+	}
+
+	return n + bytes + end, nil
+}
+
+// trailersFollow reports whether the handler declared trailers of its own,
+// which WriteTrailers sends after the last chunk.
+func (w *Writer) trailersFollow() bool {
+	for name := range w.declared {
+		if w.digests == nil || !w.digests.produces(name) {
+			return true
+		}
+	}
+	return false
 }
 
+// WriteChunkedBodyDone writes the last chunk. Unless the handler declared
+// trailers of its own that ends the response, along with the digest
+// trailers. Otherwise WriteTrailers or Finish has to follow: the server
+// calls Finish once the handler returns but other users of NewWriter must
+// do so themselves.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.hijacked {
+		return 0, ERROR_HIJACKED
+	}
+
 	if w.writerState != stateBody {
 		return 0, fmt.Errorf("This should never happen...")
 	}
 
-	bytes, err := w.writer.Write([]byte("0\r\n\r\n"))
+	// Closing the connection is what ends the body
+	if w.head || w.closeDelimited {
+		w.writerState = stateTrailers
+		return 0, nil
+	}
+
+	bytes, err := w.writeString("0\r\n")
 	if err != nil {
 		return 0, fmt.Errorf("Failed to write end of chunked data to body")
 	}
-
 	w.writerState = stateTrailers
+
+	// The handler's trailers are written by WriteTrailers or Finish.
+	// Otherwise nothing else can follow, so the response ends here.
+	if !w.trailersFollow() {
+		if err := w.WriteTrailers(*headers.NewHeaders()); err != nil {
+			return bytes, err
+		}
+	}
 	return bytes, nil
 }
 
+// WriteTrailers ends a chunked response with the trailer fields in h, which
+// must all have been declared in the Trailer header. Nothing is written if
+// any of them is rejected.
 func (w *Writer) WriteTrailers(h headers.Headers) error {
-	for k, v := range h.GetAll() {
-		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
-		if err != nil {
-			return fmt.Errorf("Failed to write trailers")
+	if w.hijacked {
+		return ERROR_HIJACKED
+	}
+
+	if !w.chunked && !w.closeDelimited {
+		return ERROR_TRAILERS_NOT_CHUNKED
+	}
+	if w.writerState != stateTrailers {
+		return ERROR_TRAILERS_TOO_EARLY
+	}
+
+	for name := range h.GetAll() {
+		if !TrailerAllowed(name) {
+			return fmt.Errorf("%w: %s", ERROR_TRAILER_FORBIDDEN, name)
+		}
+		if !w.declared[name] {
+			return fmt.Errorf("%w: %s", ERROR_TRAILER_NOT_DECLARED, name)
 		}
 	}
-	_, err := w.writer.Write([]byte("\r\n"))
+
+	// There is nowhere to put trailers without chunked framing
+	if w.head || w.closeDelimited {
+		w.writerState = stateDone
+		return nil
+	}
+
+	if w.digests != nil {
+		h = *h.Clone()
+		w.digests.addTrailers(&h)
+	}
+
+	if err := w.writeFieldLines(h); err != nil {
+		return fmt.Errorf("Failed to write trailers")
+	}
+	_, err := w.writeString("\r\n")
 	if err != nil {
 		return fmt.Errorf("Failed to write end of request")
 	}
 	w.writerState = stateDone
 	return nil
 }
+
+// Finish completes a chunked response whose trailers were never written.
+// The server calls it once the handler returns.
+func (w *Writer) Finish() error {
+	if err := w.runBeforeFinish(); err != nil {
+		return err
+	}
+
+	if w.writerState != stateTrailers {
+		return nil
+	}
+
+	if w.head || w.closeDelimited {
+		w.writerState = stateDone
+		return nil
+	}
+
+	if w.digests != nil {
+		return w.WriteTrailers(*headers.NewHeaders())
+	}
+
+	_, err := w.writeString("\r\n")
+	if err != nil {
+		return err
+	}
+
+	w.writerState = stateDone
+	return nil
+}
@@ -0,0 +1,207 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+)
+
+func chunkedWriter(t *testing.T, sb *strings.Builder, declare string) *Writer {
+	return chunkedWriterFrom(t, NewWriter(sb), sb, declare)
+}
+
+func chunkedWriterFrom(t *testing.T, w *Writer, sb *strings.Builder, declare string) *Writer {
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	if declare != "" {
+		h.Set("Trailer", declare)
+	}
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	return w
+}
+
+func trailers(fields ...string) headers.Headers {
+	h := headers.NewHeaders()
+	for i := 0; i < len(fields); i += 2 {
+		h.Set(fields[i], fields[i+1])
+	}
+	return *h
+}
+
+func TestTrailerValidation(t *testing.T) {
+	// Test: Declared trailers follow the last chunk
+	var sb strings.Builder
+	w := chunkedWriter(t, &sb, "X-Sum, X-Count")
+	w.WriteChunkedBody([]byte("data"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.WriteTrailers(trailers("X-Sum", "42")))
+	assert.True(t, strings.HasSuffix(sb.String(), "4\r\ndata\r\n0\r\nx-sum: 42\r\n\r\n"), sb.String())
+
+	// Test: Not before the body is done
+	sb.Reset()
+	w = chunkedWriter(t, &sb, "X-Sum")
+	w.WriteChunkedBody([]byte("data"))
+	assert.ErrorIs(t, w.WriteTrailers(trailers("X-Sum", "42")), ERROR_TRAILERS_TOO_EARLY)
+
+	// Test: Undeclared names are rejected and nothing is written
+	w.WriteChunkedBodyDone()
+	before := sb.Len()
+	assert.ErrorIs(t, w.WriteTrailers(trailers("X-Sum", "42", "X-Other", "1")), ERROR_TRAILER_NOT_DECLARED)
+	assert.Equal(t, before, sb.Len())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(sb.String(), "0\r\n\r\n"))
+
+	// Test: Without chunked framing there are no trailers
+	sb.Reset()
+	w = NewWriter(&sb)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(4))
+	w.WriteBody([]byte("data"))
+	assert.ErrorIs(t, w.WriteTrailers(trailers("X-Sum", "42")), ERROR_TRAILERS_NOT_CHUNKED)
+
+	// Test: Forbidden fields can be neither declared nor sent
+	for _, name := range []string{"Content-Length", "Transfer-Encoding", "Host", "Authorization", "Set-Cookie", "Content-Type", "Trailer"} {
+		sb.Reset()
+		w = NewWriter(&sb)
+		w.WriteStatusLine(StatusOK)
+		h := GetDefaultHeaders(0)
+		h.Set("Trailer", "X-Sum, "+name)
+		assert.ErrorIs(t, w.WriteHeaders(h), ERROR_TRAILER_FORBIDDEN, name)
+
+		w = chunkedWriter(t, &sb, "X-Sum")
+		w.WriteChunkedBodyDone()
+		assert.ErrorIs(t, w.WriteTrailers(trailers(name, "1")), ERROR_TRAILER_FORBIDDEN, name)
+	}
+
+	// Test: HTTP/1.0 clients get no trailers, but the rules still apply
+	sb.Reset()
+	w = NewWriter(&sb)
+	w.SetHTTP10(true)
+	w.WriteStatusLine(StatusOK)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("data"))
+	w.WriteChunkedBodyDone()
+	assert.ErrorIs(t, w.WriteTrailers(trailers("X-Other", "1")), ERROR_TRAILER_NOT_DECLARED)
+	require.NoError(t, w.WriteTrailers(trailers("X-Sum", "42")))
+	assert.True(t, strings.HasSuffix(sb.String(), "\r\n\r\ndata"), sb.String())
+}
+
+func TestDigestTrailers(t *testing.T) {
+	assert.Equal(t, "sha-256", PreferredDigest("sha-512=3, sha-256=10"))
+	assert.Equal(t, "sha-512", PreferredDigest("md5=10, sha-512=1"))
+	assert.Equal(t, "", PreferredDigest("sha-256=0, unixsum=5"))
+
+	// Test: The digests of what was streamed follow as trailers, next to
+	// the handler's own
+	var sb strings.Builder
+	w := NewWriter(&sb)
+	require.NoError(t, w.SetDigestTrailers(ContentDigest, "sha-256"))
+	require.NoError(t, w.SetDigestTrailers("Repr-Digest", "sha-512"))
+	assert.ErrorIs(t, w.SetDigestTrailers(ContentDigest, "md5"), ERROR_UNSUPPORTED_DIGEST)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Done")
+	w.WriteStatusLine(StatusOK)
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteChunkedBody([]byte("hello "))
+	w.WriteChunkedBody([]byte("world"))
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.WriteTrailers(trailers("X-Done", "yes")))
+
+	r, err := ResponseFromReader(strings.NewReader(sb.String()), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	for field, want := range map[string]string{
+		"x-done":           "yes",
+		"x-content-length": "11",
+		"x-content-sha256": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		"content-digest":   "sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:",
+		"repr-digest":      "sha-512=:MJ7MSJwS1utMxA9QyQLytNDtd+5RGnx6m808qG1M2G+YndNbxf9JlnDaNCVbRbDP2DDoH2Bdz33FVC6TrpzXbw==:",
+	} {
+		got, _ := r.Trailers.Get(field)
+		assert.Equal(t, want, got, field)
+	}
+	declared, _ := r.Headers.Get("trailer")
+	assert.Equal(t, "X-Done,content-digest,repr-digest,x-content-length,x-content-sha256", declared)
+
+	// Test: Nothing unless asked for
+	sb.Reset()
+	w = chunkedWriter(t, &sb, "")
+	w.WriteChunkedBody([]byte("hello world"))
+	w.WriteChunkedBodyDone()
+	assert.True(t, strings.HasSuffix(sb.String(), "\r\n\r\nb\r\nhello world\r\n0\r\n\r\n"), sb.String())
+
+	// Test: Without trailers of its own the digests end the response with
+	// the last chunk
+	sb.Reset()
+	w = NewWriter(&sb)
+	w.SetDigestTrailers(ContentDigest, "sha-512")
+	w = chunkedWriterFrom(t, w, &sb, "")
+	w.WriteChunkedBodyDone()
+	r, err = ResponseFromReader(strings.NewReader(sb.String()), "GET")
+	require.NoError(t, err)
+	digest, _ := r.Trailers.Get("content-digest")
+	assert.True(t, strings.HasPrefix(digest, "sha-512=:"), digest)
+	sum, _ := r.Trailers.Get("x-content-sha256")
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", sum)
+	_, ok := r.Trailers.Get("repr-digest")
+	assert.False(t, ok)
+
+	// Test: HEAD responses have no body to digest
+	sb.Reset()
+	w = NewWriter(&sb)
+	w.SetHead(true)
+	w.SetDigestTrailers(ContentDigest, "sha-256")
+	w = chunkedWriterFrom(t, w, &sb, "")
+	assert.NotContains(t, sb.String(), "trailer")
+
+	// Test: Fixed length bodies are left alone
+	sb.Reset()
+	w = NewWriter(&sb)
+	w.SetDigestTrailers(ContentDigest, "sha-256")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(GetDefaultHeaders(2))
+	w.WriteBody([]byte("hi"))
+	assert.NotContains(t, sb.String(), "trailer")
+}
+
+func TestBeforeHeaders(t *testing.T) {
+	// Test: Fields added by a hook are sent but don't reach the caller's headers
+	var sb strings.Builder
+	w := NewWriter(&sb)
+	w.BeforeHeaders(func(h *headers.Headers) error {
+		h.Set("Set-Cookie", "id=1")
+		return nil
+	})
+	h := GetDefaultHeaders(5)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Contains(t, sb.String(), "set-cookie: id=1\r\n")
+	_, ok := h.Get("Set-Cookie")
+	assert.False(t, ok)
+
+	// Test: A failing hook answers with an empty 500 instead
+	failed := fmt.Errorf("Cookie too large")
+	sb.Reset()
+	w = NewWriter(&sb)
+	w.BeforeHeaders(func(h *headers.Headers) error {
+		return failed
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.ErrorIs(t, w.WriteHeaders(GetDefaultHeaders(5)), failed)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error \r\ncontent-length: 0\r\ncontent-type: text/plain\r\nconnection: close\r\n\r\n", sb.String())
+	_, err := w.WriteBody([]byte("hello"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a closing connection keeps reading so the client gets our last
+// response before the socket is torn down
+const closeLinger = 500 * time.Millisecond
+
+// pipeline hands out one slot per request on a connection. Slots write to
+// the connection strictly in request order: a slot whose predecessors are
+// still running buffers its output until it is at the head of the line.
+type pipeline struct {
+	conn net.Conn
+	// bounds the requests in flight on the connection
+	sem  chan struct{}
+	tail chan struct{}
+	wg   sync.WaitGroup
+	// the slot handed out last, guarded by mu
+	last *slot
+	// the connection only times out while no request is in flight, so
+	// long running responses such as event streams stay open
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	hijacked bool
+	inFlight int
+}
+
+func newPipeline(conn net.Conn, max int, idleTimeout time.Duration) *pipeline {
+	ready := make(chan struct{})
+	close(ready)
+
+	return &pipeline{
+		conn:        conn,
+		sem:         make(chan struct{}, max),
+		tail:        ready,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// startIdle arms the idle timeout if nothing is in flight. Deadlines are
+// only changed under the lock so a finishing slot can't re-arm the timeout
+// after a new request started.
+func (p *pipeline) startIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inFlight == 0 && !p.closed && p.idleTimeout > 0 {
+		p.conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+	}
+}
+
+// next blocks while the maximum number of requests is already in flight.
+func (p *pipeline) next() *slot {
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+
+	s := &slot{
+		p:     p,
+		ready: p.tail,
+		done:  make(chan struct{}),
+	}
+	p.tail = s.done
+
+	p.mu.Lock()
+	p.inFlight++
+	if !p.closed && p.idleTimeout > 0 {
+		p.conn.SetReadDeadline(time.Time{})
+	}
+	if p.last != nil {
+		p.last.next = s
+	}
+	p.last = s
+	p.mu.Unlock()
+
+	return s
+}
+
+func (p *pipeline) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+func (p *pipeline) write(b []byte) (int, error) {
+	if p.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	return p.conn.Write(b)
+}
+
+// close stops any further responses. The read side stays open a little
+// longer so closing does not reset the connection under the client.
+func (p *pipeline) close() {
+	p.mu.Lock()
+	hijacked := p.hijacked
+	p.closed = true
+	p.mu.Unlock()
+
+	if hijacked {
+		return
+	}
+
+	if tcp, ok := p.conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	p.conn.SetReadDeadline(time.Now().Add(closeLinger))
+}
+
+// hijack gives the connection away. Nothing is written to it afterwards and
+// it is left open for the new owner.
+func (p *pipeline) hijack() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.hijacked = true
+}
+
+func (p *pipeline) isHijacked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.hijacked
+}
+
+// wait returns once every slot has finished.
+func (p *pipeline) wait() {
+	p.wg.Wait()
+}
+
+type slot struct {
+	p     *pipeline
+	ready <-chan struct{}
+	done  chan struct{}
+	// the slot after this one, guarded by p.mu
+	next *slot
+
+	// guards buf and live, which the previous slot changes when it hands
+	// over the turn
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	live bool
+}
+
+func (s *slot) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := s.p.write(s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
+
+// goLive sends what the slot wrote while waiting for its turn. Output such
+// as a 100 Continue must not wait for the slot's next write, which may only
+// come once the client has sent the body it is holding back.
+func (s *slot) goLive() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.live {
+		return nil
+	}
+	s.live = true
+	return s.flush()
+}
+
+func (s *slot) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.live {
+		select {
+		case <-s.ready:
+			s.live = true
+			if err := s.flush(); err != nil {
+				return 0, err
+			}
+		default:
+			return s.buf.Write(b)
+		}
+	}
+
+	return s.p.write(b)
+}
+
+// ReadFrom copies src straight to the connection, which on TCP sends a
+// file with sendfile(2). Rather than holding a large body in memory it
+// waits for the slot's turn.
+func (s *slot) ReadFrom(src io.Reader) (int64, error) {
+	<-s.ready
+	if err := s.goLive(); err != nil {
+		return 0, err
+	}
+
+	if s.p.isClosed() {
+		return 0, net.ErrClosed
+	}
+	return io.Copy(s.p.conn, src)
+}
+
+// hijack waits for the slot's turn, sends anything already written and
+// hands the connection over.
+func (s *slot) hijack() net.Conn {
+	<-s.ready
+	s.goLive()
+	s.p.hijack()
+
+	return s.p.conn
+}
+
+// finish waits for the slot's turn, sends anything still buffered and
+// hands the turn to the next slot, sending what it has written so far.
+// closeConn ends the connection after this response.
+func (s *slot) finish(closeConn bool) {
+	<-s.ready
+	s.goLive()
+
+	if closeConn {
+		s.p.close()
+	}
+
+	s.p.mu.Lock()
+	s.p.inFlight--
+	next := s.next
+	s.p.mu.Unlock()
+	s.p.startIdle()
+
+	close(s.done)
+	// A slot handed out later finds ready closed and goes live itself
+	if next != nil {
+		next.goLive()
+	}
+	<-s.p.sem
+	s.p.wg.Done()
+}
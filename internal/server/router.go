@@ -0,0 +1,135 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+// Router dispatches requests to handlers by path and method. A pattern
+// ending in "/" matches every path below it, the longest match wins.
+//
+// HEAD falls back to the GET handler and OPTIONS is answered with the
+// route's Allow set unless handlers are registered for them.
+type Router struct {
+	routes map[string]map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes: map[string]map[string]Handler{},
+	}
+}
+
+func (rt *Router) Handle(method, pattern string, handler Handler) {
+	if rt.routes[pattern] == nil {
+		rt.routes[pattern] = map[string]Handler{}
+	}
+
+	rt.routes[pattern][method] = handler
+}
+
+func (rt *Router) match(path string) (map[string]Handler, bool) {
+	if methods, ok := rt.routes[path]; ok {
+		return methods, true
+	}
+
+	best := ""
+	for pattern := range rt.routes {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+
+	if best == "" {
+		return nil, false
+	}
+	return rt.routes[best], true
+}
+
+func allowed(methods map[string]Handler) []string {
+	allow := map[string]bool{request.MethodOptions: true}
+	for method := range methods {
+		allow[method] = true
+		if method == request.MethodGet {
+			allow[request.MethodHead] = true
+		}
+	}
+
+	names := make([]string, 0, len(allow))
+	for method := range allow {
+		names = append(names, method)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Allow lists the methods path can be requested with.
+func (rt *Router) Allow(path string) []string {
+	methods, ok := rt.match(path)
+	if !ok {
+		return nil
+	}
+
+	return allowed(methods)
+}
+
+// allowAll is the answer to OPTIONS *, every method any route accepts
+func (rt *Router) allowAll() []string {
+	all := map[string]Handler{}
+	for _, methods := range rt.routes {
+		for method, h := range methods {
+			all[method] = h
+		}
+	}
+
+	return allowed(all)
+}
+
+func replyAllow(w *response.Writer, status response.StatusCode, allow []string) {
+	h := response.GetDefaultHeaders(0)
+	if status == response.StatusNoContent {
+		h.Delete("Content-Length")
+	}
+	h.Set("Allow", strings.Join(allow, ", "))
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+}
+
+// Serve is a Handler, pass it to Serve to use the router.
+func (rt *Router) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+
+	if req.Target.Form == request.FormAsterisk {
+		replyAllow(w, response.StatusOK, rt.allowAll())
+		return
+	}
+
+	methods, ok := rt.match(req.Path())
+	if !ok {
+		writeError(w, response.StatusNotFound)
+		return
+	}
+
+	handler, ok := methods[method]
+	if !ok && method == request.MethodHead {
+		// The writer drops the body, so the GET handler produces exactly
+		// the headers a GET would get
+		handler, ok = methods[request.MethodGet]
+	}
+
+	if !ok && method == request.MethodOptions {
+		replyAllow(w, response.StatusNoContent, allowed(methods))
+		return
+	}
+
+	if !ok {
+		replyAllow(w, response.StatusMethodNotAllowed, allowed(methods))
+		return
+	}
+
+	handler(w, req)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	router.Handle(request.MethodGet, "/", echoPath)
+	router.Handle(request.MethodGet, "/video", func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(10)
+		h.Replace("Content-Type", "video/mp4")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("0123456789"))
+	})
+	router.Handle(request.MethodPost, "/api/", echoPath)
+	router.Handle(request.MethodDelete, "/api/items", echoPath)
+	router.Handle(request.MethodGet, "/chunked", chunkedReply)
+	addr := startServer(t, router.Serve)
+
+	// Test: Prefix patterns, longest wins
+	out := roundTrip(t, addr, "POST /api/users HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"))
+	assert.True(t, strings.HasSuffix(out, "/api/users"))
+
+	// Test: HEAD runs the GET handler without the body
+	out = roundTrip(t, addr, "HEAD /video HTTP/1.1\r\nHost: x\r\n\r\nGET /after HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "content-length: 10\r\n")
+	assert.Contains(t, out, "content-type: video/mp4\r\n")
+	assert.NotContains(t, out, "0123456789")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n/after"))
+
+	// Test: HEAD of a chunked response has no chunks
+	out = roundTrip(t, addr, "HEAD /chunked HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	assert.NotContains(t, out, "hello")
+
+	// Test: Default OPTIONS lists the route's methods
+	out = roundTrip(t, addr, "OPTIONS /video HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content"))
+	assert.Contains(t, out, "allow: GET, HEAD, OPTIONS\r\n")
+	assert.NotContains(t, out, "content-length")
+
+	// Test: OPTIONS * lists every method
+	out = roundTrip(t, addr, "OPTIONS * HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "allow: DELETE, GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: Method not allowed
+	out = roundTrip(t, addr, "PUT /api/items HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed"))
+	assert.Contains(t, out, "allow: DELETE, OPTIONS\r\n")
+
+	assert.Equal(t, []string{"GET", "HEAD", "OPTIONS"}, router.Allow("/anything"))
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := NewRouter()
+	router.Handle(request.MethodGet, "/only", echoPath)
+	addr := startServer(t, router.Serve)
+
+	out := roundTrip(t, addr, "GET /other HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found"))
+	assert.Nil(t, router.Allow("/other"))
+}
@@ -1,22 +1,60 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
+	"go.serve/internal/headers"
 	"go.serve/internal/request"
 	"go.serve/internal/response"
 )
 
+const (
+	defaultMaxPipelined = 16
+	defaultIdleTimeout  = 2 * time.Minute
+)
+
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	closed   bool
+	listener     net.Listener
+	handler      Handler
+	closed       bool
+	maxPipelined int
+	idleTimeout  time.Duration
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
+type Option func(s *Server)
+
+// WithMaxPipelined caps how many requests on one connection are handled
+// before their responses have been sent. Further requests are not read
+// until a response goes out.
+func WithMaxPipelined(n int) Option {
+	return func(s *Server) {
+		s.maxPipelined = max(n, 1)
+	}
+}
+
+// WithIdleTimeout sets how long a connection may sit between requests.
+// Zero disables the timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// Addr is the address the server listens on, useful when serving on
+// port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) Close() error {
 	s.closed = true
 	return nil
@@ -36,29 +74,237 @@ func (s *Server) listen() {
 	}
 }
 
+// errorStatus picks the response for a request that failed to parse. It
+// returns false when there is nobody left to answer, e.g. the client went
+// away.
+func errorStatus(err error) (response.StatusCode, bool) {
+	switch {
+	case errors.Is(err, request.ERROR_HEADERS_TOO_LARGE):
+		return response.StatusHeaderFieldsTooLarge, true
+	case errors.Is(err, request.ERROR_UNSUPPORTED_TRANSFER_ENCODING),
+		errors.Is(err, request.ERROR_METHOD_NOT_IMPLEMENTED):
+		return response.StatusNotImplemented, true
+	case errors.Is(err, request.ERROR_HTTP_VERSION_NOT_SUPPORTED):
+		return response.StatusHTTPVersionNotSupported, true
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, request.ERROR_BODY_NOT_CONSUMED):
+		return 0, false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return 0, false
+	}
+
+	return response.StatusBadRequest, true
+}
+
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	// Cancelled once we stop reading from the client, which for a
+	// long running handler usually means the client went away
+	ctx, cancel := context.WithCancel(context.Background())
 
-	responseWriter := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(response.GetDefaultHeaders(0))
-		return
+	reader := request.NewReader(conn)
+	pipe := newPipeline(conn, s.maxPipelined, s.idleTimeout)
+	h := &hijacker{reader: reader}
+
+	defer func() {
+		// A handler that took over the connection keeps its context until
+		// it returns
+		if !pipe.isHijacked() {
+			cancel()
+		}
+		pipe.wait()
+		cancel()
+		// Nothing reads from the connection any more
+		reader.Release()
+
+		if !pipe.isHijacked() {
+			conn.Close()
+		}
+	}()
+
+	for !pipe.isClosed() {
+		pipe.startIdle()
+
+		req, err := h.next()
+		if pipe.isClosed() {
+			return
+		}
+		if err != nil {
+			if status, ok := errorStatus(err); ok {
+				slot := pipe.next()
+				writeError(response.NewWriter(slot), status)
+				slot.finish(true)
+			}
+			return
+		}
+
+		// The next request starts where this body ends, so only requests
+		// without a body are handled while we read ahead. After an upgrade
+		// or CONNECT the bytes that follow belong to another protocol.
+		// Decided now, as the request is released once it is answered.
+		wait := req.HasBody() || !req.KeepAlive() || switchesProtocol(req)
+
+		req = req.WithContext(ctx)
+		req.RemoteAddr = conn.RemoteAddr().String()
+		slot := pipe.next()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// Its buffer goes to a later request on the connection
+			defer req.Release()
+			s.serve(slot, req, h)
+		}()
+
+		if wait {
+			<-done
+		}
 	}
+}
+
+// switchesProtocol reports whether the connection is likely to be taken
+// over once the request is answered.
+func switchesProtocol(req *request.Request) bool {
+	return req.RequestLine.Method == request.MethodConnect ||
+		req.Headers.HasToken("connection", "upgrade")
+}
+
+// hijacker hands a connection to a handler while the server may be reading
+// ahead for the next pipelined request.
+type hijacker struct {
+	reader *request.Reader
+	// held while reading the next request
+	reading sync.Mutex
+	stopped bool
+}
+
+// next reads the next request unless the connection was hijacked.
+func (h *hijacker) next() (*request.Request, error) {
+	h.reading.Lock()
+	defer h.reading.Unlock()
+
+	if h.stopped {
+		return nil, net.ErrClosed
+	}
+
+	return h.reader.Next()
+}
+
+// hijack waits for the slot's turn and stops the server from using the
+// connection. Requests pipelined behind the hijacked one that were already
+// read are dropped; bytes not yet parsed are returned to the caller.
+func (h *hijacker) hijack(slot *slot) (net.Conn, []byte, error) {
+	conn := slot.hijack()
+
+	// Wake up a read of the next request and wait for it to give up
+	conn.SetReadDeadline(time.Now())
+	h.reading.Lock()
+	defer h.reading.Unlock()
+
+	h.stopped = true
+	conn.SetDeadline(time.Time{})
+
+	return conn, append([]byte(nil), h.reader.Buffered()...), nil
+}
+
+// Request fields asking for each digest field
+var wantDigest = map[string]string{
+	"want-content-digest": response.ContentDigest,
+	"want-repr-digest":    response.ReprDigest,
+}
+
+func (s *Server) serve(slot *slot, req *request.Request, h *hijacker) {
+	// Whatever the handler started in the background learns it is over
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	responseWriter := response.NewBufferedWriter(slot)
+	responseWriter.SetKeepAlive(req.KeepAlive())
+	responseWriter.SetHTTP10(req.RequestLine.IsHTTP10())
+	responseWriter.SetHead(req.RequestLine.Method == request.MethodHead)
+	responseWriter.SetHijacker(func() (net.Conn, []byte, error) {
+		return h.hijack(slot)
+	})
+
+	// 100-continue is the only expectation defined (RFC 9110 10.1.1).
+	// HTTP/1.0 clients don't know about it and their Expect is ignored.
+	if _, ok := req.Headers.Get("expect"); ok && !req.RequestLine.IsHTTP10() {
+		if !req.ExpectsContinue() {
+			responseWriter.SetKeepAlive(false)
+			writeError(responseWriter, response.StatusExpectationFailed)
+			responseWriter.Release()
+			slot.finish(true)
+			return
+		}
+
+		// The client waits for our go ahead, which we only give once the
+		// handler actually wants the body. Handlers that reply first with
+		// 413 or 417 never see it sent.
+		req.OnBodyRead(responseWriter.WriteContinue)
+	}
+
+	// Clients may ask for the integrity of chunked responses to be
+	// provable (RFC 9530 section 4)
+	for want, field := range wantDigest {
+		if value, ok := req.Headers.Get(want); ok {
+			if algorithm := response.PreferredDigest(value); algorithm != "" {
+				responseWriter.SetDigestTrailers(field, algorithm)
+			}
+		}
+	}
+
+	// A body the client never sent can't be skipped to reach the next
+	// request, so the connection has to close
+	responseWriter.BeforeHeaders(func(h *headers.Headers) error {
+		if req.AwaitingContinue() {
+			h.Replace("Connection", "close")
+		}
+		return nil
+	})
 
 	s.handler(responseWriter, req)
+	req.Cleanup()
+	if responseWriter.Hijacked() {
+		slot.finish(false)
+		return
+	}
+
+	// A body that failed its integrity check gets a 400, unless the
+	// handler already answered
+	var digestErr *request.DigestError
+	if errors.As(req.BodyError(), &digestErr) && !responseWriter.Started() {
+		writeError(responseWriter, response.StatusBadRequest)
+	}
+	responseWriter.Finish()
+	// Whatever the handler left in the buffer goes out now
+	responseWriter.Release()
+
+	slot.finish(!responseWriter.KeepAlive())
 }
 
-func Serve(port uint16, handler Handler) (*Server, error) {
+func writeError(w *response.Writer, status response.StatusCode) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+}
+
+func Serve(port uint16, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
 
 	s := &Server{
-		handler:  handler,
-		listener: listener,
+		handler:      handler,
+		listener:     listener,
+		maxPipelined: defaultMaxPipelined,
+		idleTimeout:  defaultIdleTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	go s.listen()
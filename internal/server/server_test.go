@@ -0,0 +1,407 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+func startServer(t *testing.T, handler Handler, opts ...Option) net.Addr {
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s.Addr()
+}
+
+// roundTrip sends raw on a fresh connection and returns everything the
+// server writes until it closes the connection or goes quiet.
+func roundTrip(t *testing.T, addr net.Addr, raw string) string {
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	out, _ := io.ReadAll(conn)
+	return string(out)
+}
+
+func reply(w *response.Writer, status response.StatusCode, body string) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func echoPath(w *response.Writer, req *request.Request) {
+	reply(w, response.StatusOK, req.Path())
+}
+
+func TestPipelining(t *testing.T) {
+	// Test: Responses follow request order even when the first is slowest
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		echoPath(w, req)
+	})
+
+	out := roundTrip(t, addr, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /fast HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"POST /body HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc"+
+		"POST /chunked HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"+
+		"GET /last HTTP/1.1\r\nHost: x\r\n\r\n")
+
+	assert.Equal(t, 5, strings.Count(out, "HTTP/1.1 200 OK"))
+	order := []string{"/slow", "/fast", "/body", "/chunked", "/last"}
+	last := -1
+	for _, path := range order {
+		idx := strings.Index(out, "\r\n\r\n"+path)
+		require.NotEqual(t, -1, idx, path)
+		assert.Greater(t, idx, last, path)
+		last = idx
+	}
+
+	// Test: Connection: close ends the connection after that response
+	out = roundTrip(t, addr, "GET /one HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "connection: close\r\n")
+}
+
+func TestPipeliningCap(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		n := inFlight.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Add(-1)
+		echoPath(w, req)
+	}, WithMaxPipelined(2))
+
+	raw := strings.Repeat("GET / HTTP/1.1\r\nHost: x\r\n\r\n", 6)
+	out := roundTrip(t, addr, raw)
+	assert.Equal(t, 6, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+}
+
+func TestBadRequests(t *testing.T) {
+	addr := startServer(t, echoPath)
+
+	// Test: Conflicting framing
+	out := roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: Unknown transfer coding
+	out = roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented"))
+
+	// Test: Oversized header section
+	out = roundTrip(t, addr, "GET / HTTP/1.1\r\nX-Big: "+strings.Repeat("a", 10000)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large"))
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if req.ContentLength() > 10 {
+			reply(w, response.StatusContentTooLarge, "")
+			return
+		}
+
+		body, err := req.ReadBody()
+		if !assert.NoError(t, err) {
+			return
+		}
+		reply(w, response.StatusOK, string(body))
+	})
+
+	// Test: 100 Continue is sent before the body is read
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(buf[:n]))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "HTTP/1.1 200 OK"))
+	assert.True(t, strings.HasSuffix(string(buf[:n]), "hello"))
+
+	// Test: Behind a slower request, 100 Continue goes out as soon as that
+	// one is answered, without waiting for the body
+	conn, err = net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"PUT / HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+	var head strings.Builder
+	for !strings.HasSuffix(head.String(), "HTTP/1.1 100 Continue\r\n\r\n") {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err, head.String())
+		head.WriteString(line)
+	}
+	assert.True(t, strings.HasPrefix(head.String(), "HTTP/1.1 200 OK"))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "HTTP/1.1 200 OK"), line)
+
+	// Test: Rejected before reading, without 100 Continue
+	out := roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 500\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: Unknown expectation
+	out = roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nExpect: teapot\r\nContent-Length: 5\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed"))
+}
+
+func chunkedReply(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Done")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteChunkedBody([]byte("hello "))
+	w.WriteChunkedBody([]byte("world"))
+	w.WriteChunkedBodyDone()
+
+	tr := headers.NewHeaders()
+	tr.Set("X-Done", "yes")
+	w.WriteTrailers(*tr)
+}
+
+func TestHTTP10(t *testing.T) {
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/chunked" {
+			chunkedReply(w, req)
+			return
+		}
+		echoPath(w, req)
+	})
+
+	// Test: Connection closes after one response by default
+	out := roundTrip(t, addr, "GET /one HTTP/1.0\r\n\r\nGET /two HTTP/1.0\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: Keep-alive opt in is acknowledged
+	out = roundTrip(t, addr, "GET /one HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"+
+		"GET /two HTTP/1.0\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "connection: keep-alive\r\n")
+
+	// Test: Chunked responses become close delimited
+	out = roundTrip(t, addr, "GET /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.NotContains(t, out, "trailer")
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello world"))
+
+	// Test: HTTP/1.1 still gets chunked
+	out = roundTrip(t, addr, "GET /chunked HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\nx-done: yes\r\n\r\n"))
+
+	// Test: Expect is ignored for HTTP/1.0
+	out = roundTrip(t, addr, "POST /x HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"))
+
+	// Test: HTTP/2 is rejected
+	out = roundTrip(t, addr, "GET / HTTP/2.0\r\nHost: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported"))
+}
+
+func TestUnknownMethod(t *testing.T) {
+	called := false
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		called = true
+		echoPath(w, req)
+	})
+
+	out := roundTrip(t, addr, "BREW /pot HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 501 Not Implemented"))
+	assert.False(t, called)
+}
+
+func TestHijack(t *testing.T) {
+	writeErr := make(chan error, 1)
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() != "/hijack" {
+			echoPath(w, req)
+			return
+		}
+
+		w.WriteStatusLine(response.StatusSwitchingProtocols)
+		w.WriteHeaders(*headers.NewHeaders())
+
+		conn, buffered, err := w.Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		_, err = w.WriteBody([]byte("too late"))
+		writeErr <- err
+
+		// Outlive the idle timeout to show the server cleared it
+		time.Sleep(100 * time.Millisecond)
+
+		// Echo the raw stream, starting with what the server read ahead
+		conn.Write([]byte("raw:"))
+		conn.Write(buffered)
+		io.Copy(conn, conn)
+	}, WithIdleTimeout(50*time.Millisecond))
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Earlier pipelined responses go out first, and bytes after the
+	// hijacked request are handed over instead of parsed
+	_, err = conn.Write([]byte("GET /first HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"GET /hijack HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"not http"))
+	require.NoError(t, err)
+
+	assert.Equal(t, response.ERROR_HIJACKED, <-writeErr)
+
+	_, err = conn.Write([]byte(" at all"))
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, _ := io.ReadAll(conn)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\n/first"+
+		"HTTP/1.1 101 Switching Protocols \r\n\r\n"+
+		"raw:not http at all"), string(out))
+
+	// Test: A request pipelined behind the hijacked one gets no response
+	raw := roundTrip(t, addr, "GET /hijack HTTP/1.1\r\nHost: x\r\n\r\nGET /next HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-writeErr
+	assert.True(t, strings.HasSuffix(raw, "raw:"), raw)
+	assert.NotContains(t, raw, "/next")
+}
+
+func TestWantDigest(t *testing.T) {
+	addr := startServer(t, chunkedReply)
+
+	// Test: Want-Content-Digest adds the preferred digest as a trailer
+	out := roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nWant-Content-Digest: sha-512=1, sha-256=5\r\n\r\n")
+	assert.Contains(t, out, "\r\n0\r\n")
+	assert.Contains(t, out, "content-digest: sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:\r\n")
+	assert.Contains(t, out, "x-content-sha256: b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9\r\n")
+	assert.Contains(t, out, "x-content-length: 11\r\n")
+	assert.Contains(t, out, "x-done: yes\r\n")
+	assert.NotContains(t, out, "repr-digest")
+
+	// Test: Want-Repr-Digest adds its own field
+	out = roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nWant-Repr-Digest: sha-512\r\n\r\n")
+	assert.Contains(t, out, "repr-digest: sha-512=:MJ7MSJwS1utMxA9QyQLytNDtd+5RGnx6m808qG1M2G+YndNbxf9JlnDaNCVbRbDP2DDoH2Bdz33FVC6TrpzXbw==:\r\n")
+	assert.NotContains(t, out, "content-digest")
+
+	// Test: Nothing unless asked for
+	out = roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	assert.NotContains(t, out, "digest")
+	assert.NotContains(t, out, "x-content-")
+
+	// Test: Not for HEAD
+	out = roundTrip(t, addr, "HEAD / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nWant-Content-Digest: sha-256\r\n\r\n")
+	assert.NotContains(t, out, "digest")
+}
+
+func TestBodyDigest(t *testing.T) {
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if _, err := req.ReadBody(); err == nil {
+			reply(w, response.StatusOK, "ok")
+		}
+	})
+	digest := "Content-Digest: sha-256=:uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=:\r\n"
+
+	// Test: A body matching its digest reaches the handler
+	out := roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n"+digest+"Content-Length: 11\r\n\r\nhello world")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK"), out)
+
+	// Test: One that doesn't is a bad request, and the connection lives on
+	out = roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: x\r\n"+digest+"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"+
+		"POST / HTTP/1.1\r\nHost: x\r\nConnection: close\r\nContent-Length: 2\r\n\r\nhi")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request"), out)
+	assert.Contains(t, out, "HTTP/1.1 200 OK")
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big")
+	content := strings.Repeat("0123456789abcdef", 64<<10)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+			reply(w, response.StatusOK, "slow")
+			return
+		}
+
+		// Only the test goroutine may stop the test, so no require here
+		f, err := os.Open(path)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer f.Close()
+		rangeHeader, _ := req.Headers.Get("range")
+		w.WriteFile(f, response.GetDefaultHeaders(0), rangeHeader)
+	})
+
+	// Test: The file goes straight to the connection, after the responses
+	// to earlier pipelined requests
+	out := roundTrip(t, addr, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /file HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /file HTTP/1.1\r\nHost: x\r\nRange: bytes=16-31\r\nConnection: close\r\n\r\n")
+	first, rest, ok := strings.Cut(out, "\r\n\r\nslow")
+	require.True(t, ok, out)
+	assert.True(t, strings.HasPrefix(first, "HTTP/1.1 200 OK"))
+	assert.True(t, strings.HasPrefix(rest, "HTTP/1.1 200 OK"))
+	assert.Contains(t, rest, "\r\n\r\n"+content+"HTTP/1.1 206 Partial Content")
+	assert.Contains(t, rest, "content-range: bytes 16-31/1048576\r\n")
+	assert.True(t, strings.HasSuffix(rest, "\r\n\r\n0123456789abcdef"))
+}
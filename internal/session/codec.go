@@ -0,0 +1,129 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Key is one signing key and, optionally, an AES key (16, 24 or 32 bytes)
+// used to encrypt the cookie contents with AES-GCM.
+type Key struct {
+	Hash  []byte
+	Block []byte
+}
+
+var ERROR_NO_KEYS = fmt.Errorf("At least one session key is required")
+var ERROR_INVALID_SIGNATURE = fmt.Errorf("Invalid session signature")
+var ERROR_INVALID_COOKIE = fmt.Errorf("Malformed session cookie")
+var ERROR_EXPIRED = fmt.Errorf("Session expired")
+
+var encoding = base64.RawURLEncoding
+
+func sign(key []byte, name, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte("|"))
+	mac.Write([]byte(value))
+
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encode packs the expiry time and data, encrypts them when the key has a
+// block key and signs the result. The cookie name is part of the MAC so a
+// value cannot be moved between cookies.
+func encode(key Key, name string, data []byte, expires time.Time) (string, error) {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	payload = append(payload, data...)
+
+	if key.Block != nil {
+		gcm, err := newGCM(key.Block)
+		if err != nil {
+			return "", err
+		}
+
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		payload = gcm.Seal(nonce, nonce, payload, []byte(name))
+	}
+
+	value := encoding.EncodeToString(payload)
+	mac := sign(key.Hash, name, value)
+
+	return value + "." + encoding.EncodeToString(mac), nil
+}
+
+// decode tries every key in order, so older keys keep verifying cookies
+// while the first key is used to sign new ones.
+func decode(keys []Key, name, cookie string, now time.Time) ([]byte, error) {
+	value, sig, found := strings.Cut(cookie, ".")
+	if !found {
+		return nil, ERROR_INVALID_COOKIE
+	}
+
+	mac, err := encoding.DecodeString(sig)
+	if err != nil {
+		return nil, ERROR_INVALID_COOKIE
+	}
+
+	var key *Key
+	for i := range keys {
+		if hmac.Equal(mac, sign(keys[i].Hash, name, value)) {
+			key = &keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, ERROR_INVALID_SIGNATURE
+	}
+
+	payload, err := encoding.DecodeString(value)
+	if err != nil {
+		return nil, ERROR_INVALID_COOKIE
+	}
+
+	if key.Block != nil {
+		gcm, err := newGCM(key.Block)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(payload) < gcm.NonceSize() {
+			return nil, ERROR_INVALID_COOKIE
+		}
+		nonce := payload[:gcm.NonceSize()]
+		payload, err = gcm.Open(nil, nonce, payload[gcm.NonceSize():], []byte(name))
+		if err != nil {
+			return nil, ERROR_INVALID_COOKIE
+		}
+	}
+
+	if len(payload) < 8 {
+		return nil, ERROR_INVALID_COOKIE
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[:8])), 0)
+	if !now.Before(expires) {
+		return nil, ERROR_EXPIRED
+	}
+
+	return payload[8:], nil
+}
@@ -0,0 +1,261 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.serve/internal/cookie"
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+	"go.serve/internal/server"
+)
+
+// Browsers are only required to store cookies up to this size
+const maxCookieSize = 4096
+
+var ERROR_COOKIE_TOO_LARGE = fmt.Errorf("Session cookie too large")
+var ERROR_INVALID_KEY = fmt.Errorf("Session hash keys must not be empty")
+
+type Options struct {
+	// Name of the cookie, defaults to "session"
+	Name string
+	// Keys[0] signs new cookies, every key is tried when verifying
+	Keys   []Key
+	MaxAge time.Duration
+	Path   string
+	Domain string
+	Secure bool
+	// SameSite defaults to Lax
+	SameSite cookie.SameSite
+	// Store is optional, without one the values live in the cookie
+	Store Store
+}
+
+type Manager struct {
+	opts Options
+}
+
+func NewManager(opts Options) (*Manager, error) {
+	if len(opts.Keys) == 0 {
+		return nil, ERROR_NO_KEYS
+	}
+
+	for _, k := range opts.Keys {
+		if len(k.Hash) == 0 {
+			return nil, ERROR_INVALID_KEY
+		}
+		if k.Block != nil {
+			if _, err := newGCM(k.Block); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.Name == "" {
+		opts.Name = "session"
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == cookie.SameSiteDefault {
+		opts.SameSite = cookie.SameSiteLax
+	}
+
+	return &Manager{opts: opts}, nil
+}
+
+// cookieData is what the cookie carries when there is no Store
+type cookieData struct {
+	ID     string            `json:"id"`
+	Values map[string]string `json:"values"`
+}
+
+type Session struct {
+	ID string
+
+	mu        sync.Mutex
+	values    map[string]string
+	isNew     bool
+	modified  bool
+	destroyed bool
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return encoding.EncodeToString(b)
+}
+
+func newSession() *Session {
+	return &Session{
+		ID:     newID(),
+		values: map[string]string{},
+		isNew:  true,
+	}
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = value
+	s.modified = true
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+	s.modified = true
+}
+
+// Destroy clears the session and expires the cookie on the client.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = map[string]string{}
+	s.destroyed = true
+}
+
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// Load returns the session carried by the request, or a new empty session
+// if there is none or it fails verification.
+func (m *Manager) Load(req *request.Request) *Session {
+	c, err := req.Cookie(m.opts.Name)
+	if err != nil {
+		return newSession()
+	}
+
+	data, err := decode(m.opts.Keys, m.opts.Name, c.Value, time.Now())
+	if err != nil {
+		return newSession()
+	}
+
+	s := &Session{}
+	if m.opts.Store != nil {
+		s.ID = string(data)
+		s.values, err = m.opts.Store.Load(s.ID)
+		if err != nil {
+			return newSession()
+		}
+		return s
+	}
+
+	var cd cookieData
+	if err := json.Unmarshal(data, &cd); err != nil || cd.ID == "" {
+		return newSession()
+	}
+	s.ID = cd.ID
+	s.values = cd.Values
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	return s
+}
+
+func (m *Manager) newCookie(value string) *cookie.Cookie {
+	return &cookie.Cookie{
+		Name:     m.opts.Name,
+		Value:    value,
+		Path:     m.opts.Path,
+		Domain:   m.opts.Domain,
+		MaxAge:   int(m.opts.MaxAge / time.Second),
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	}
+}
+
+// Save writes the session cookie into h if the session changed.
+func (m *Manager) Save(s *Session, h *headers.Headers) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.destroyed {
+		if m.opts.Store != nil {
+			if err := m.opts.Store.Delete(s.ID); err != nil {
+				return err
+			}
+		}
+
+		c := m.newCookie("")
+		c.MaxAge = -1
+		return response.SetCookie(h, c)
+	}
+
+	if !s.modified {
+		return nil
+	}
+
+	expires := time.Now().Add(m.opts.MaxAge)
+
+	var data []byte
+	if m.opts.Store != nil {
+		if err := m.opts.Store.Save(s.ID, s.values, expires); err != nil {
+			return err
+		}
+		data = []byte(s.ID)
+	} else {
+		var err error
+		data, err = json.Marshal(cookieData{ID: s.ID, Values: s.values})
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := encode(m.opts.Keys[0], m.opts.Name, data, expires)
+	if err != nil {
+		return err
+	}
+
+	c := m.newCookie(value)
+	if len(c.String()) > maxCookieSize {
+		return ERROR_COOKIE_TOO_LARGE
+	}
+
+	return response.SetCookie(h, c)
+}
+
+type contextKey struct{}
+
+// FromRequest returns the session attached by Middleware, or nil.
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+// Middleware loads the session before calling next and saves it when the
+// handler writes its headers. Changes made after WriteHeaders are lost.
+func (m *Manager) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		s := m.Load(req)
+
+		w.BeforeHeaders(func(h *headers.Headers) error {
+			return m.Save(s, h)
+		})
+
+		next(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, s)))
+	}
+}
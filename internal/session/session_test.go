@@ -0,0 +1,158 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+)
+
+func requestWithCookie(t *testing.T, cookie string) *request.Request {
+	raw := "GET / HTTP/1.1\r\nHost: localhost:42069\r\n"
+	if cookie != "" {
+		raw += "Cookie: " + cookie + "\r\n"
+	}
+	raw += "\r\n"
+
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+// roundTrip saves s and feeds the resulting cookie back through Load
+func roundTrip(t *testing.T, m *Manager, s *Session) *Session {
+	h := headers.NewHeaders()
+	require.NoError(t, m.Save(s, h))
+
+	setCookie := h.Values("set-cookie")
+	require.Len(t, setCookie, 1)
+	pair, _, _ := strings.Cut(setCookie[0], ";")
+
+	return m.Load(requestWithCookie(t, pair))
+}
+
+func TestCodec(t *testing.T) {
+	now := time.Now()
+	signed := Key{Hash: []byte("hash-key")}
+	encrypted := Key{Hash: []byte("hash-key"), Block: []byte("0123456789abcdef")}
+
+	// Test: Signed round trip
+	value, err := encode(signed, "s", []byte("hello"), now.Add(time.Minute))
+	require.NoError(t, err)
+	data, err := decode([]Key{signed}, "s", value, now)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: Encrypted round trip hides the data
+	value, err = encode(encrypted, "s", []byte("hello"), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.NotContains(t, value, encoding.EncodeToString([]byte("hello")))
+	data, err = decode([]Key{encrypted}, "s", value, now)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: Tampered value
+	tampered := "A" + value[1:]
+	if value[0] == 'A' {
+		tampered = "B" + value[1:]
+	}
+	_, err = decode([]Key{encrypted}, "s", tampered, now)
+	assert.Equal(t, ERROR_INVALID_SIGNATURE, err)
+
+	// Test: Value moved to another cookie name
+	_, err = decode([]Key{encrypted}, "other", value, now)
+	assert.Equal(t, ERROR_INVALID_SIGNATURE, err)
+
+	// Test: Expired
+	_, err = decode([]Key{encrypted}, "s", value, now.Add(2*time.Minute))
+	assert.Equal(t, ERROR_EXPIRED, err)
+
+	// Test: Rotated keys still verify old cookies
+	rotated := []Key{{Hash: []byte("new-key")}, signed}
+	value, err = encode(signed, "s", []byte("old"), now.Add(time.Minute))
+	require.NoError(t, err)
+	data, err = decode(rotated, "s", value, now)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	// Test: Malformed
+	_, err = decode([]Key{signed}, "s", "garbage", now)
+	assert.Equal(t, ERROR_INVALID_COOKIE, err)
+}
+
+func TestManagerCookieSession(t *testing.T) {
+	m, err := NewManager(Options{
+		Keys: []Key{{Hash: []byte("hash-key"), Block: []byte("0123456789abcdef")}},
+	})
+	require.NoError(t, err)
+
+	// Test: No cookie gives a new session
+	s := m.Load(requestWithCookie(t, ""))
+	assert.True(t, s.IsNew())
+
+	// Test: Unmodified sessions are not saved
+	h := headers.NewHeaders()
+	require.NoError(t, m.Save(s, h))
+	assert.Len(t, h.Values("set-cookie"), 0)
+
+	// Test: Values survive a round trip
+	s.Set("user", "alice")
+	loaded := roundTrip(t, m, s)
+	assert.False(t, loaded.IsNew())
+	assert.Equal(t, s.ID, loaded.ID)
+	v, ok := loaded.Get("user")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", v)
+
+	// Test: Destroy expires the cookie
+	loaded.Destroy()
+	h = headers.NewHeaders()
+	require.NoError(t, m.Save(loaded, h))
+	require.Len(t, h.Values("set-cookie"), 1)
+	assert.Contains(t, h.Values("set-cookie")[0], "Max-Age=0")
+
+	// Test: Invalid cookie gives a new session
+	s = m.Load(requestWithCookie(t, "session=forged.value"))
+	assert.True(t, s.IsNew())
+}
+
+func TestManagerStoreSession(t *testing.T) {
+	store := NewMemoryStore()
+	m, err := NewManager(Options{
+		Keys:  []Key{{Hash: []byte("hash-key")}},
+		Store: store,
+	})
+	require.NoError(t, err)
+
+	s := m.Load(requestWithCookie(t, ""))
+	s.Set("cart", "3 items")
+	loaded := roundTrip(t, m, s)
+	assert.Equal(t, s.ID, loaded.ID)
+	v, _ := loaded.Get("cart")
+	assert.Equal(t, "3 items", v)
+
+	// Test: Deleting from the store invalidates the cookie
+	require.NoError(t, store.Delete(s.ID))
+	s.Set("cart", "4 items")
+	h := headers.NewHeaders()
+	require.NoError(t, m.Save(s, h))
+	pair, _, _ := strings.Cut(h.Values("set-cookie")[0], ";")
+	require.NoError(t, store.Delete(s.ID))
+	assert.True(t, m.Load(requestWithCookie(t, pair)).IsNew())
+}
+
+func TestNewManager(t *testing.T) {
+	_, err := NewManager(Options{})
+	assert.Equal(t, ERROR_NO_KEYS, err)
+
+	_, err = NewManager(Options{Keys: []Key{{}}})
+	assert.Equal(t, ERROR_INVALID_KEY, err)
+
+	_, err = NewManager(Options{Keys: []Key{{Hash: []byte("k"), Block: []byte("short")}}})
+	assert.Error(t, err)
+}
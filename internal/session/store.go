@@ -0,0 +1,86 @@
+package session
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ERROR_SESSION_NOT_FOUND = fmt.Errorf("Session not found")
+
+// Store keeps session values on the server. When a Manager has a Store the
+// cookie only carries the signed session ID.
+type Store interface {
+	Load(id string) (map[string]string, error)
+	Save(id string, values map[string]string, expires time.Time) error
+	Delete(id string) error
+}
+
+type memoryEntry struct {
+	values  map[string]string
+	expires time.Time
+}
+
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: map[string]memoryEntry{},
+	}
+}
+
+func copyValues(values map[string]string) map[string]string {
+	c := make(map[string]string, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+
+	return c
+}
+
+func (s *MemoryStore) Load(id string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.sessions[id]
+	if !ok {
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+
+	if !time.Now().Before(entry.expires) {
+		delete(s.sessions, id)
+		return nil, ERROR_SESSION_NOT_FOUND
+	}
+
+	return copyValues(entry.values), nil
+}
+
+func (s *MemoryStore) Save(id string, values map[string]string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired sessions while we hold the lock anyway
+	now := time.Now()
+	for k, entry := range s.sessions {
+		if !now.Before(entry.expires) {
+			delete(s.sessions, k)
+		}
+	}
+
+	s.sessions[id] = memoryEntry{
+		values:  copyValues(values),
+		expires: expires,
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
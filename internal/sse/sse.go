@@ -0,0 +1,212 @@
+package sse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+var ERROR_INVALID_FIELD = fmt.Errorf("Event and ID fields must not contain line breaks")
+var ERROR_STREAM_CLOSED = fmt.Errorf("Event stream closed")
+
+// Event is one message of a text/event-stream (HTML Living Standard,
+// section 9.2). Empty fields are left out.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+type Options struct {
+	// Heartbeat is how often a comment is sent to keep idle connections
+	// open and notice clients that left. Zero disables heartbeats.
+	Heartbeat time.Duration
+	// Retry is sent once at the start, telling clients how long to wait
+	// before reconnecting
+	Retry time.Duration
+}
+
+// Writer streams events to one client. It is safe to use from several
+// goroutines.
+type Writer struct {
+	mu     sync.Mutex
+	w      *response.Writer
+	closed bool
+
+	// done is closed once the client disconnects or Close is called
+	done chan struct{}
+	once sync.Once
+}
+
+// LastEventID is the ID of the last event a reconnecting client saw.
+func LastEventID(req *request.Request) string {
+	id, _ := req.Headers.Get("Last-Event-ID")
+	return id
+}
+
+// NewWriter writes the event stream headers and starts the heartbeat.
+func NewWriter(w *response.Writer, req *request.Request, opts Options) (*Writer, error) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Replace("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	// The client learns the stream is open before the first event
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s := &Writer{
+		w:    w,
+		done: make(chan struct{}),
+	}
+
+	if opts.Retry > 0 {
+		if err := s.write(fmt.Sprintf("retry: %d\n\n", opts.Retry.Milliseconds())); err != nil {
+			return nil, err
+		}
+	}
+
+	// The heartbeat must not outlive the handler, the response it writes
+	// to is reused once the handler returns
+	w.BeforeFinish(s.Close)
+
+	go s.watch(req, opts.Heartbeat)
+	return s, nil
+}
+
+// watch ends the stream when the connection goes away and sends
+// heartbeats, which is also how a dead client gets noticed.
+func (s *Writer) watch(req *request.Request, heartbeat time.Duration) {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-req.Context().Done():
+			s.stop()
+			return
+		case <-tick:
+			s.Comment("heartbeat")
+		}
+	}
+}
+
+func (s *Writer) stop() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// Done is closed when the client disconnects or the stream is closed.
+func (s *Writer) Done() <-chan struct{} {
+	return s.done
+}
+
+// write sends one complete event as a single chunk and flushes it so it
+// reaches the client straight away.
+func (s *Writer) write(data string) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ERROR_STREAM_CLOSED
+	}
+
+	_, err := s.w.WriteChunkedBody([]byte(data))
+	if err == nil {
+		err = s.w.Flush()
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.stop()
+	}
+	return err
+}
+
+func format(e Event) (string, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return "", ERROR_INVALID_FIELD
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+
+	// Every line of the data gets its own field, the client joins them
+	// back together with "\n"
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+func (s *Writer) Send(e Event) error {
+	data, err := format(e)
+	if err != nil {
+		return err
+	}
+
+	return s.write(data)
+}
+
+// Comment sends a line clients ignore, e.g. to keep the connection busy.
+func (s *Writer) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	return s.write(b.String())
+}
+
+// Close ends the stream. The handler should return afterwards; returning
+// without calling it closes the stream as well.
+func (s *Writer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	_, err := s.w.WriteChunkedBodyDone()
+	s.mu.Unlock()
+
+	s.stop()
+	return err
+}
@@ -0,0 +1,126 @@
+package sse
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+	"go.serve/internal/server"
+)
+
+func TestFormat(t *testing.T) {
+	// Test: All fields
+	data, err := format(Event{ID: "42", Event: "update", Data: "hello", Retry: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "id: 42\nevent: update\nretry: 3000\ndata: hello\n\n", data)
+
+	// Test: Multi-line data
+	data, err = format(Event{Data: "one\ntwo\r\nthree\rfour"})
+	require.NoError(t, err)
+	assert.Equal(t, "data: one\ndata: two\ndata: three\ndata: four\n\n", data)
+
+	// Test: Empty data still produces a data field
+	data, err = format(Event{Event: "ping"})
+	require.NoError(t, err)
+	assert.Equal(t, "event: ping\ndata: \n\n", data)
+
+	// Test: Line breaks in single line fields
+	_, err = format(Event{ID: "1\n2"})
+	assert.Equal(t, ERROR_INVALID_FIELD, err)
+	_, err = format(Event{Event: "a\rb"})
+	assert.Equal(t, ERROR_INVALID_FIELD, err)
+}
+
+func TestStream(t *testing.T) {
+	lastID := make(chan string, 1)
+	disconnected := make(chan struct{})
+
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		lastID <- LastEventID(req)
+
+		// Only the test goroutine may stop the test, so no require here
+		events, err := NewWriter(w, req, Options{Heartbeat: 20 * time.Millisecond, Retry: time.Second})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.NoError(t, events.Send(Event{ID: "8", Data: "first\nsecond"}))
+
+		<-events.Done()
+		close(disconnected)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: x\r\nLast-Event-ID: 7\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "7", <-lastID)
+
+	// Read until the first heartbeat arrives
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	var out strings.Builder
+	for !strings.Contains(out.String(), ": heartbeat\n") {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		out.WriteString(line)
+	}
+
+	assert.Contains(t, out.String(), "content-type: text/event-stream\r\n")
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.Contains(t, out.String(), "retry: 1000\n\n")
+	assert.Contains(t, out.String(), "id: 8\ndata: first\ndata: second\n\n")
+
+	// Test: The handler notices the client leaving
+	conn.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect not detected")
+	}
+}
+
+func TestReturnWithoutClose(t *testing.T) {
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		events, err := NewWriter(w, req, Options{Heartbeat: time.Millisecond})
+		if err != nil {
+			return
+		}
+		events.Send(Event{Data: "only"})
+		// Let a few heartbeats go out, then return without Close
+		time.Sleep(20 * time.Millisecond)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The stream is ended and the connection reused, with no
+	// heartbeat written into the next response
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	first, err := response.ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Contains(t, string(first.Body), "data: only\n\n")
+
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	second, err := response.ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(second.Body), "data: only\n\n"), string(second.Body))
+}
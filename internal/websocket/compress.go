@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// Messages shorter than this are sent uncompressed, deflate would only
+// make them longer
+const minCompressSize = 64
+
+// The largest distance a deflate back-reference can reach
+const windowSize = 32 << 10
+
+// A sender removes the empty stored block that ends a flushed deflate
+// stream (RFC 7692 section 7.2.1). We put it back, followed by a final
+// empty block so the reader stops at the end of the message.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflate compresses one message without reference to earlier ones.
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4]), nil
+}
+
+// inflate decompresses a message from the peer, refusing to produce more
+// than limit bytes. A peer that keeps its compression context may refer
+// back to earlier messages, which window holds.
+func (c *Conn) inflate(data []byte, limit int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	fr := flate.NewReaderDict(src, c.window)
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, ERROR_INVALID_PAYLOAD
+	}
+	if int64(len(out)) > limit {
+		return nil, ERROR_MESSAGE_TOO_LARGE
+	}
+
+	if c.peerTakeover {
+		window := append(c.window, out...)
+		if len(window) > windowSize {
+			window = append([]byte(nil), window[len(window)-windowSize:]...)
+		}
+		c.window = window
+	}
+
+	return out, nil
+}
@@ -0,0 +1,322 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const defaultMaxMessageSize = 1 << 20
+
+// How long Close waits for the peer to answer our close frame
+const closeTimeout = time.Second
+
+// Close status codes (RFC 6455 section 7.4.1)
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	// Reported when the peer's close frame carried no code, never sent
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+var ERROR_PROTOCOL = fmt.Errorf("WebSocket protocol violation")
+var ERROR_MESSAGE_TOO_LARGE = fmt.Errorf("WebSocket message too large")
+var ERROR_INVALID_PAYLOAD = fmt.Errorf("Invalid WebSocket message payload")
+var ERROR_INVALID_MESSAGE_TYPE = fmt.Errorf("Invalid WebSocket message type")
+var ERROR_CONTROL_TOO_LARGE = fmt.Errorf("Control frame payload too large")
+var ERROR_CONN_CLOSED = fmt.Errorf("WebSocket connection closed")
+
+// CloseError is returned by ReadMessage once the peer closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is an open WebSocket connection. One goroutine may read while
+// others write.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+
+	subprotocol    string
+	maxMessageSize int64
+	fragmentSize   int
+	onPong         func(data []byte)
+
+	// permessage-deflate
+	compress     bool
+	peerTakeover bool
+	window       []byte
+
+	rmu       sync.Mutex
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool, opts Options) *Conn {
+	maxMessageSize := opts.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+
+	return &Conn{
+		conn:           conn,
+		br:             br,
+		client:         client,
+		maxMessageSize: maxMessageSize,
+		fragmentSize:   opts.FragmentSize,
+	}
+}
+
+// Subprotocol is the protocol agreed on in the handshake, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// OnPong registers fn to run for every pong the peer sends. Pings are
+// answered automatically.
+func (c *Conn) OnPong(fn func(data []byte)) {
+	c.onPong = fn
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragments and handling control frames on the way. Once the peer closes
+// the connection it returns a *CloseError.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	var (
+		msgType    MessageType
+		compressed bool
+		message    []byte
+	)
+
+	for {
+		f, err := c.readFrame(c.maxMessageSize - int64(len(message)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.op {
+		case PingMessage:
+			if err := c.writeControl(PongMessage, f.data); err != nil && err != ERROR_CONN_CLOSED {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		case PongMessage:
+			if c.onPong != nil {
+				c.onPong(f.data)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.closeReceived(f.data)
+		case TextMessage, BinaryMessage:
+			if msgType != 0 {
+				return 0, nil, c.fail(ERROR_PROTOCOL)
+			}
+			msgType = f.op
+			compressed = f.rsv1
+		case continuation:
+			// Only the first frame of a message marks it as compressed
+			if msgType == 0 || f.rsv1 {
+				return 0, nil, c.fail(ERROR_PROTOCOL)
+			}
+		}
+
+		message = append(message, f.data...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			if message, err = c.inflate(message, c.maxMessageSize); err != nil {
+				return 0, nil, c.fail(err)
+			}
+		}
+
+		if msgType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(ERROR_INVALID_PAYLOAD)
+		}
+
+		return msgType, message, nil
+	}
+}
+
+// fail tells the peer why we are closing, if the connection is still
+// usable, and closes it.
+func (c *Conn) fail(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ERROR_PROTOCOL):
+		code = CloseProtocolError
+	case errors.Is(err, ERROR_MESSAGE_TOO_LARGE):
+		code = CloseMessageTooBig
+	case errors.Is(err, ERROR_INVALID_PAYLOAD):
+		code = CloseInvalidPayload
+	}
+
+	if code != 0 {
+		c.writeControl(CloseMessage, closePayload(code, ""))
+	}
+
+	c.conn.Close()
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003,
+		code >= 1007 && code <= 1014,
+		code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// closeReceived answers the peer's close frame with our own and ends the
+// connection.
+func (c *Conn) closeReceived(data []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+
+	switch {
+	case len(data) == 1:
+		return c.fail(ERROR_PROTOCOL)
+	case len(data) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(data))
+		closeErr.Reason = string(data[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(ERROR_PROTOCOL)
+		}
+		if !utf8.Valid(data[2:]) {
+			return c.fail(ERROR_INVALID_PAYLOAD)
+		}
+	}
+
+	reply := []byte{}
+	if len(data) >= 2 {
+		reply = data[:2]
+	}
+	c.writeControl(CloseMessage, reply)
+
+	c.conn.Close()
+	return closeErr
+}
+
+// WriteMessage sends a message. Text and binary messages are compressed
+// and fragmented as negotiated; ping, pong and close go out as a single
+// control frame.
+func (c *Conn) WriteMessage(t MessageType, data []byte) error {
+	if t.isControl() {
+		return c.writeControl(t, data)
+	}
+	if t != TextMessage && t != BinaryMessage {
+		return ERROR_INVALID_MESSAGE_TYPE
+	}
+
+	compressed := false
+	if c.compress && len(data) >= minCompressSize {
+		var err error
+		if data, err = deflate(data); err != nil {
+			return err
+		}
+		compressed = true
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ERROR_CONN_CLOSED
+	}
+
+	op := t
+	for {
+		n := len(data)
+		if c.fragmentSize > 0 && n > c.fragmentSize {
+			n = c.fragmentSize
+		}
+		fin := n == len(data)
+
+		err := c.writeFrame(frame{
+			fin:  fin,
+			rsv1: compressed && op != continuation,
+			op:   op,
+			data: data[:n],
+		})
+		if err != nil || fin {
+			return err
+		}
+
+		data = data[n:]
+		op = continuation
+	}
+}
+
+func (c *Conn) writeControl(t MessageType, data []byte) error {
+	if len(data) > maxControlPayload {
+		return ERROR_CONTROL_TOO_LARGE
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ERROR_CONN_CLOSED
+	}
+	if t == CloseMessage {
+		c.closeSent = true
+	}
+
+	return c.writeFrame(frame{fin: true, op: t, data: data})
+}
+
+// Close starts the closing handshake and closes the connection once the
+// peer answers or closeTimeout passes. If another goroutine is reading,
+// that reader sees the answer and closes the connection instead.
+func (c *Conn) Close(code int, reason string) error {
+	if err := c.writeControl(CloseMessage, closePayload(code, reason)); err != nil {
+		c.conn.Close()
+		if err == ERROR_CONN_CLOSED {
+			return nil
+		}
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	if !c.rmu.TryLock() {
+		return nil
+	}
+	defer c.rmu.Unlock()
+
+	// Skip whatever the peer still sends until its close frame
+	for {
+		f, err := c.readFrame(c.maxMessageSize)
+		if err != nil || f.op == CloseMessage {
+			break
+		}
+	}
+
+	return c.conn.Close()
+}
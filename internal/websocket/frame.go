@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+type MessageType int
+
+// Frame opcodes (RFC 6455 section 5.2)
+const (
+	continuation  MessageType = 0x0
+	TextMessage   MessageType = 0x1
+	BinaryMessage MessageType = 0x2
+	CloseMessage  MessageType = 0x8
+	PingMessage   MessageType = 0x9
+	PongMessage   MessageType = 0xa
+)
+
+func (t MessageType) isControl() bool {
+	return t >= CloseMessage
+}
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	// rsv2 and rsv3 have no meaning for any extension we support
+	rsvOther = 0x30
+	maskBit  = 0x80
+
+	maxControlPayload = 125
+)
+
+type frame struct {
+	fin  bool
+	rsv1 bool
+	op   MessageType
+	data []byte
+}
+
+// readFrame reads one frame whose payload may be at most limit bytes.
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	var f frame
+
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return f, err
+	}
+
+	f.fin = head[0]&finBit != 0
+	f.rsv1 = head[0]&rsv1Bit != 0
+	f.op = MessageType(head[0] & 0x0f)
+	masked := head[1]&maskBit != 0
+
+	switch f.op {
+	case continuation, TextMessage, BinaryMessage:
+	case CloseMessage, PingMessage, PongMessage:
+		if !f.fin || f.rsv1 {
+			return f, ERROR_PROTOCOL
+		}
+	default:
+		return f, ERROR_PROTOCOL
+	}
+
+	if head[0]&rsvOther != 0 || (f.rsv1 && !c.compress) {
+		return f, ERROR_PROTOCOL
+	}
+
+	// Clients mask everything they send, servers nothing
+	if masked == c.client {
+		return f, ERROR_PROTOCOL
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, ERROR_PROTOCOL
+		}
+	}
+
+	if f.op.isControl() && length > maxControlPayload {
+		return f, ERROR_PROTOCOL
+	}
+	if !f.op.isControl() && length > uint64(limit) {
+		return f, ERROR_MESSAGE_TOO_LARGE
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return f, err
+		}
+	}
+
+	f.data = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.data); err != nil {
+		return f, err
+	}
+
+	if masked {
+		maskBytes(key, f.data)
+	}
+
+	return f, nil
+}
+
+// writeFrame sends one frame. The caller holds c.wmu.
+func (c *Conn) writeFrame(f frame) error {
+	b0 := byte(f.op)
+	if f.fin {
+		b0 |= finBit
+	}
+	if f.rsv1 {
+		b0 |= rsv1Bit
+	}
+
+	buf := make([]byte, 0, 14+len(f.data))
+	buf = append(buf, b0)
+
+	var b1 byte
+	if c.client {
+		b1 = maskBit
+	}
+
+	length := len(f.data)
+	switch {
+	case length <= 125:
+		buf = append(buf, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if !c.client {
+		buf = append(buf, f.data...)
+		_, err := c.conn.Write(buf)
+		return err
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	buf = append(buf, key[:]...)
+
+	// Masking a copy leaves the caller's data alone
+	start := len(buf)
+	buf = append(buf, f.data...)
+	maskBytes(key, buf[start:])
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
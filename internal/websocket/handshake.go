@@ -0,0 +1,232 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"go.serve/internal/headers"
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+)
+
+// Appended to the client's key to prove the server speaks WebSocket
+// (RFC 6455 section 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ERROR_NOT_WEBSOCKET = fmt.Errorf("Request is not a WebSocket upgrade")
+var ERROR_UNSUPPORTED_VERSION = fmt.Errorf("Unsupported WebSocket version")
+var ERROR_INVALID_KEY = fmt.Errorf("Invalid Sec-WebSocket-Key")
+var ERROR_ORIGIN_NOT_ALLOWED = fmt.Errorf("Origin not allowed")
+
+type Options struct {
+	// Subprotocols the server speaks, in order of preference
+	Subprotocols []string
+	// CheckOrigin decides whether a browser on another site may connect.
+	// By default only requests without an Origin or from the same host
+	// are accepted.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize limits a received message after decompression.
+	// Defaults to 1 MiB.
+	MaxMessageSize int64
+	// FragmentSize splits sent messages into frames of at most this many
+	// bytes. Zero sends every message as a single frame.
+	FragmentSize int
+	// Compression enables permessage-deflate when the client offers it
+	Compression bool
+}
+
+// AcceptKey computes Sec-WebSocket-Accept for a client's key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether req asks to switch to WebSocket.
+func IsUpgrade(req *request.Request) bool {
+	return req.Headers.HasToken("connection", "upgrade") &&
+		req.Headers.HasToken("upgrade", "websocket")
+}
+
+func checkHandshake(req *request.Request) (string, error) {
+	if req.RequestLine.Method != request.MethodGet || req.RequestLine.IsHTTP10() || !IsUpgrade(req) {
+		return "", ERROR_NOT_WEBSOCKET
+	}
+
+	if version, _ := req.Headers.Get("sec-websocket-version"); version != "13" {
+		return "", ERROR_UNSUPPORTED_VERSION
+	}
+
+	key, _ := req.Headers.Get("sec-websocket-key")
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(nonce) != 16 {
+		return "", ERROR_INVALID_KEY
+	}
+
+	return key, nil
+}
+
+// sameOrigin accepts clients that are not browsers, and browsers on a page
+// served by this host.
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers.Get("origin")
+	if !ok {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	host, _ := req.Headers.Get("host")
+	return strings.EqualFold(u.Host, host)
+}
+
+func listValues(h *headers.Headers, name string) []string {
+	var list []string
+	for _, value := range h.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+func selectSubprotocol(req *request.Request, supported []string) string {
+	offered := listValues(&req.Headers, "sec-websocket-protocol")
+	for _, protocol := range supported {
+		for _, o := range offered {
+			if o == protocol {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// negotiateDeflate picks the first permessage-deflate offer we can honour
+// (RFC 7692). We always compress each message on its own, so we can take
+// any offer that does not limit our window below the 32 KiB flate uses.
+// It returns the extension response and whether the client resets its
+// compression context between messages.
+func negotiateDeflate(req *request.Request) (string, bool, bool) {
+offers:
+	for _, offer := range listValues(&req.Headers, "sec-websocket-extensions") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+
+		clientNoTakeover := false
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover":
+			case "client_no_context_takeover":
+				clientNoTakeover = true
+			case "client_max_window_bits":
+			case "server_max_window_bits":
+				if value != "15" {
+					continue offers
+				}
+			default:
+				continue offers
+			}
+		}
+
+		extension := "permessage-deflate; server_no_context_takeover"
+		if clientNoTakeover {
+			extension += "; client_no_context_takeover"
+		}
+		return extension, clientNoTakeover, true
+	}
+
+	return "", false, false
+}
+
+func reject(w *response.Writer, status response.StatusCode, h headers.Headers) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+}
+
+// Upgrade completes the opening handshake and takes over the connection.
+// When the request is not a valid handshake it answers with an error
+// status and returns the reason.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	key, err := checkHandshake(req)
+	if err != nil {
+		h := response.GetDefaultHeaders(0)
+		status := response.StatusBadRequest
+		if err == ERROR_UNSUPPORTED_VERSION {
+			status = response.StatusUpgradeRequired
+			h.Set("Sec-WebSocket-Version", "13")
+		}
+		reject(w, status, h)
+		return nil, err
+	}
+
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		reject(w, response.StatusForbidden, response.GetDefaultHeaders(0))
+		return nil, ERROR_ORIGIN_NOT_ALLOWED
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+
+	subprotocol := selectSubprotocol(req, opts.Subprotocols)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	compress, clientNoTakeover := false, false
+	if opts.Compression {
+		var extension string
+		extension, clientNoTakeover, compress = negotiateDeflate(req)
+		if compress {
+			h.Set("Sec-WebSocket-Extensions", extension)
+		}
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	var head bytes.Buffer
+	head.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", response.StatusSwitchingProtocols, response.StatusSwitchingProtocols))
+	h.Lines(func(name, value string) error {
+		head.WriteString(name + ": " + value + "\r\n")
+		return nil
+	})
+	head.WriteString("\r\n")
+
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The client may have sent its first frames along with the handshake
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+
+	c := newConn(conn, br, false, opts)
+	c.subprotocol = subprotocol
+	c.compress = compress
+	c.peerTakeover = compress && !clientNoTakeover
+	return c, nil
+}
@@ -0,0 +1,290 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.serve/internal/request"
+	"go.serve/internal/response"
+	"go.serve/internal/server"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func handshake(extra string) string {
+	return "GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\n" +
+		extra + "\r\n"
+}
+
+// echoServer echoes every message back and reports how the connection
+// ended.
+func echoServer(t *testing.T, opts Options) (*server.Server, chan error) {
+	ended := make(chan error, 1)
+
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		ws, err := Upgrade(w, req, opts)
+		if err != nil {
+			return
+		}
+
+		for {
+			t, data, err := ws.ReadMessage()
+			if err != nil {
+				ended <- err
+				return
+			}
+			if err := ws.WriteMessage(t, data); err != nil {
+				ended <- err
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+
+	return s, ended
+}
+
+// dial performs the handshake and returns the client side of the
+// connection along with the server's response head.
+func dial(t *testing.T, s *server.Server, req string, opts Options) (*Conn, string) {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Write([]byte(req))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	c := newConn(conn, br, true, opts)
+	c.compress = strings.Contains(head.String(), "permessage-deflate")
+	return c, head.String()
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(testKey))
+}
+
+func TestEcho(t *testing.T) {
+	s, ended := echoServer(t, Options{Subprotocols: []string{"chat", "superchat"}})
+	defer s.Close()
+
+	c, head := dial(t, s, handshake("Sec-WebSocket-Protocol: superchat, chat\r\n"), Options{FragmentSize: 3})
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat\r\n")
+
+	// Test: Text message, sent in fragments
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello world")))
+	msgType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, msgType)
+	assert.Equal(t, "hello world", string(data))
+
+	// Test: Binary message
+	require.NoError(t, c.WriteMessage(BinaryMessage, []byte{0, 1, 2, 0xff}))
+	msgType, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, msgType)
+	assert.Equal(t, []byte{0, 1, 2, 0xff}, data)
+
+	// Test: Pings are answered
+	pong := make(chan string, 1)
+	c.OnPong(func(data []byte) { pong <- string(data) })
+	require.NoError(t, c.WriteMessage(PingMessage, []byte("are you there")))
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("after ping")))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+	assert.Equal(t, "are you there", <-pong)
+
+	// Test: Closing handshake
+	require.NoError(t, c.Close(CloseNormal, "bye"))
+	err = <-ended
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+}
+
+func TestBufferedFrames(t *testing.T) {
+	s, ended := echoServer(t, Options{})
+	defer s.Close()
+
+	// Test: A frame sent along with the handshake is not lost
+	var frame bytes.Buffer
+	client := &Conn{client: true, conn: writerConn{&frame}}
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("early")))
+
+	c, _ := dial(t, s, handshake("")+frame.String(), Options{})
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "early", string(data))
+
+	c.Close(CloseNormal, "")
+	<-ended
+}
+
+func TestCompression(t *testing.T) {
+	s, ended := echoServer(t, Options{Compression: true})
+	defer s.Close()
+
+	c, head := dial(t, s, handshake("Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n"), Options{})
+	assert.Contains(t, head, "sec-websocket-extensions: permessage-deflate; server_no_context_takeover\r\n")
+
+	// Test: Compressed message both ways
+	message := strings.Repeat("compress me please ", 100)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte(message)))
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+
+	// Test: The client may refer back to earlier messages
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, flate.BestSpeed, []byte(message))
+	require.NoError(t, err)
+	fw.Write([]byte(message))
+	fw.Flush()
+	compressed := bytes.TrimSuffix(buf.Bytes(), deflateTail[:4])
+	c.wmu.Lock()
+	require.NoError(t, c.writeFrame(frame{fin: true, rsv1: true, op: TextMessage, data: compressed}))
+	c.wmu.Unlock()
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+
+	c.Close(CloseNormal, "")
+	<-ended
+
+	// Test: Offers we can't honour are declined
+	s2, ended2 := echoServer(t, Options{Compression: true})
+	defer s2.Close()
+	c, head = dial(t, s2, handshake("Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10\r\n"), Options{})
+	assert.NotContains(t, head, "sec-websocket-extensions")
+	c.Close(CloseNormal, "")
+	<-ended2
+}
+
+func TestProtocolErrors(t *testing.T) {
+	s, ended := echoServer(t, Options{MaxMessageSize: 16})
+	defer s.Close()
+
+	closeCode := func(c *Conn) int {
+		_, _, err := c.ReadMessage()
+		var closeErr *CloseError
+		require.ErrorAs(t, err, &closeErr)
+		return closeErr.Code
+	}
+
+	// Test: Unmasked client frames
+	c, _ := dial(t, s, handshake(""), Options{})
+	c.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	assert.Equal(t, CloseProtocolError, closeCode(c))
+	assert.ErrorIs(t, <-ended, ERROR_PROTOCOL)
+
+	// Test: Message over the size limit
+	c, _ = dial(t, s, handshake(""), Options{FragmentSize: 10})
+	require.NoError(t, c.WriteMessage(BinaryMessage, make([]byte, 20)))
+	assert.Equal(t, CloseMessageTooBig, closeCode(c))
+	assert.ErrorIs(t, <-ended, ERROR_MESSAGE_TOO_LARGE)
+
+	// Test: Invalid UTF-8 in a text message
+	c, _ = dial(t, s, handshake(""), Options{})
+	require.NoError(t, c.WriteMessage(TextMessage, []byte{0xff, 0xfe}))
+	assert.Equal(t, CloseInvalidPayload, closeCode(c))
+	assert.ErrorIs(t, <-ended, ERROR_INVALID_PAYLOAD)
+
+	// Test: Continuation without a message
+	c, _ = dial(t, s, handshake(""), Options{})
+	c.wmu.Lock()
+	require.NoError(t, c.writeFrame(frame{fin: true, op: continuation, data: []byte("x")}))
+	c.wmu.Unlock()
+	assert.Equal(t, CloseProtocolError, closeCode(c))
+	assert.ErrorIs(t, <-ended, ERROR_PROTOCOL)
+
+	// Test: Compressed frame without negotiating compression
+	c, _ = dial(t, s, handshake(""), Options{})
+	c.compress = true
+	c.wmu.Lock()
+	require.NoError(t, c.writeFrame(frame{fin: true, rsv1: true, op: TextMessage, data: []byte("x")}))
+	c.wmu.Unlock()
+	assert.Equal(t, CloseProtocolError, closeCode(c))
+	assert.ErrorIs(t, <-ended, ERROR_PROTOCOL)
+
+	// Test: Oversized control frames can't be sent
+	c, _ = dial(t, s, handshake(""), Options{})
+	assert.Equal(t, ERROR_CONTROL_TOO_LARGE, c.WriteMessage(PingMessage, make([]byte, 126)))
+	c.Close(CloseNormal, "")
+	<-ended
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	s, _ := echoServer(t, Options{})
+	defer s.Close()
+
+	status := func(req string) string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		_, err = conn.Write([]byte(req))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		return line
+	}
+
+	// Test: Plain GET
+	assert.Equal(t, "HTTP/1.1 400 Bad Request \r\n", status("GET /ws HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	// Test: Wrong version advertises the one we speak
+	req := strings.Replace(handshake(""), "Version: 13", "Version: 8", 1)
+	assert.Equal(t, "HTTP/1.1 426 Upgrade Required \r\n", status(req))
+
+	// Test: Bad key
+	req = strings.Replace(handshake(""), testKey, "c2hvcnQ=", 1)
+	assert.Equal(t, "HTTP/1.1 400 Bad Request \r\n", status(req))
+
+	// Test: Browser on another site
+	assert.Equal(t, "HTTP/1.1 403 Forbidden \r\n", status(handshake("Origin: https://evil.example\r\n")))
+
+	// Test: Browser on our own site
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status(handshake("Origin: http://localhost\r\n")))
+}
+
+// writerConn captures what a Conn writes, used to build raw frames.
+type writerConn struct {
+	*bytes.Buffer
+}
+
+func (writerConn) Read([]byte) (int, error)         { return 0, nil }
+func (writerConn) Close() error                     { return nil }
+func (writerConn) LocalAddr() net.Addr              { return nil }
+func (writerConn) RemoteAddr() net.Addr             { return nil }
+func (writerConn) SetDeadline(time.Time) error      { return nil }
+func (writerConn) SetReadDeadline(time.Time) error  { return nil }
+func (writerConn) SetWriteDeadline(time.Time) error { return nil }